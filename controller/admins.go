@@ -0,0 +1,119 @@
+package controller
+
+import (
+	"encoding/json"
+	"errors"
+	"k8s-grafana-controller/grafana"
+	"os"
+	"strings"
+
+	"github.com/golang/glog"
+	"k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+)
+
+// OrgAdmin is a user or a team of the main org added to every tenant org with a role: Viewer, Editor or Admin
+type OrgAdmin struct {
+	User string `json:"user,omitempty"`
+	Team string `json:"team,omitempty"`
+	Role string `json:"role"`
+}
+
+// orgAdmins reads the global administrators from the "admins" key of ORG_ADMINS_CONFIGMAP, or else from ORG_ADMINS.
+// Both are json like [{"user": "admin", "role": "Admin"}, {"team": "sre", "role": "Editor"}]. ORG_ADMINS is used while the
+// ConfigMap does not exist. The default is ADMIN_NAME as Admin.
+func orgAdmins(clientset *kubernetes.Clientset) ([]OrgAdmin, error) {
+	source := os.Getenv("ORG_ADMINS")
+	if namespace, name := orgAdminsConfigMap(); name != "" {
+		cm, err := clientset.CoreV1().ConfigMaps(namespace).Get(name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			glog.Warningln("org admins configmap " + namespace + "/" + name + " not found, using ORG_ADMINS or ADMIN_NAME")
+		} else if err != nil {
+			return nil, errors.New("fail to read org admins: " + err.Error())
+		} else {
+			source = cm.Data["admins"]
+		}
+	}
+	if source == "" {
+		return []OrgAdmin{{User: adminName(), Role: "Admin"}}, nil
+	}
+	var admins []OrgAdmin
+	err := json.Unmarshal([]byte(source), &admins)
+	if err != nil {
+		return nil, errors.New("invalid org admins: " + err.Error())
+	}
+	return admins, nil
+}
+
+// addAdmins adds the global administrators to the users and teams of a tenant org. Teams get the members of the team with
+// the same name in the main org, and the folder permission of their role. It fails if the administrators cannot be read,
+// so that they are not removed from the org.
+func addAdmins(clientset *kubernetes.Clientset, grafanaClient *grafana.GrafanaClient, users map[string]string, teams map[string]grafana.Team) error {
+	admins, err := orgAdmins(clientset)
+	if err != nil {
+		return err
+	}
+	for _, admin := range admins {
+		switch {
+		case admin.User != "":
+			users[admin.User] = grafana.HigherRole(users[admin.User], admin.Role)
+		case admin.Team != "":
+			members := grafanaClient.MainOrgTeamMembers(admin.Team)
+			if members == nil {
+				glog.Warningln("admin team " + admin.Team + " not found in the main org")
+				continue
+			}
+			teams[admin.Team] = grafana.Team{Permission: teamPermissions[admin.Role], Members: members}
+		}
+	}
+	return nil
+}
+
+// WatchOrgAdmins watches ORG_ADMINS_CONFIGMAP, and reconciles the administrators of every tenant org when it is created,
+// changed or deleted
+func WatchOrgAdmins(clientset *kubernetes.Clientset, grafanaClient *grafana.GrafanaClient) {
+	namespace, name := orgAdminsConfigMap()
+	if name == "" {
+		return
+	}
+	// the configmap is read when tenants are synced, so only changes after it is listed matter
+	selector := "metadata.name=" + name
+	list, err := clientset.CoreV1().ConfigMaps(namespace).List(metav1.ListOptions{FieldSelector: selector})
+	if err != nil {
+		glog.Fatal(err)
+	}
+	watchcm, err := clientset.CoreV1().ConfigMaps(namespace).Watch(metav1.ListOptions{Watch: true, FieldSelector: selector, ResourceVersion: list.ResourceVersion})
+	if err != nil {
+		glog.Fatal(err)
+	} else {
+		eventChan := watchcm.ResultChan()
+		for event := range eventChan {
+			_, ok := event.Object.(*v1.ConfigMap)
+			if !ok {
+				glog.Errorln("unexpected type when watching configmaps")
+				continue
+			}
+			if event.Type != watch.Added && event.Type != watch.Modified && event.Type != watch.Deleted {
+				continue
+			}
+			glog.Infoln("org admins changed, syncing tenant orgs")
+			syncAllNamespaceRoles(clientset, grafanaClient)
+		}
+	}
+	glog.Flush()
+}
+
+// orgAdminsConfigMap reads ORG_ADMINS_CONFIGMAP, "namespace/name" of the ConfigMap of the global administrators. The namespace defaults to "monitoring".
+func orgAdminsConfigMap() (string, string) {
+	value := os.Getenv("ORG_ADMINS_CONFIGMAP")
+	if value == "" {
+		return "", ""
+	}
+	if i := strings.Index(value, "/"); i >= 0 {
+		return value[:i], value[i+1:]
+	}
+	return "monitoring", value
+}
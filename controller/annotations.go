@@ -0,0 +1,218 @@
+package controller
+
+import (
+	"encoding/json"
+	"hash/fnv"
+	"k8s-grafana-controller/grafana"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"golang.org/x/time/rate"
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+)
+
+// annotationTag is put on every annotation posted from kubernetes
+const annotationTag = "kubernetes"
+
+// annotationLimiter limits the annotations posted per namespace
+type annotationLimiter struct {
+	mu       sync.Mutex
+	limiters map[string]*rate.Limiter
+}
+
+func (l *annotationLimiter) allow(namespace string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	limiter, ok := l.limiters[namespace]
+	if !ok {
+		perMinute := annotationRate()
+		limiter = rate.NewLimiter(rate.Every(time.Minute/time.Duration(perMinute)), perMinute)
+		l.limiters[namespace] = limiter
+	}
+	return limiter.Allow()
+}
+
+// WatchAnnotations posts kubernetes events and rollouts of deployments and statefulsets as annotations to the organization of their namespace.
+// It does nothing unless EVENT_ANNOTATIONS is "true".
+func WatchAnnotations(clientset *kubernetes.Clientset, grafanaClient *grafana.GrafanaClient) {
+	if os.Getenv("EVENT_ANNOTATIONS") != "true" {
+		return
+	}
+	limiter := &annotationLimiter{limiters: make(map[string]*rate.Limiter)}
+	go watchEventAnnotations(clientset, grafanaClient, limiter)
+	go watchRolloutAnnotations(clientset, grafanaClient, limiter)
+}
+
+// watchRetryDelay is the wait before a closed or failed annotation watch is established again
+const watchRetryDelay = 10 * time.Second
+
+// watchEventAnnotations posts the events with a reason in ANNOTATION_EVENT_REASONS that happen after the controller starts.
+// A closed watch is established again from the last seen resource version. When it has to start over, only events after that are posted, so no event is posted twice.
+func watchEventAnnotations(clientset *kubernetes.Clientset, grafanaClient *grafana.GrafanaClient, limiter *annotationLimiter) {
+	reasons := make(map[string]bool)
+	for _, reason := range annotationEventReasons() {
+		reasons[reason] = true
+	}
+	var start time.Time
+	resourceVersion := ""
+	for {
+		if resourceVersion == "" {
+			start = time.Now()
+		}
+		watchEvents, err := clientset.CoreV1().Events("").Watch(metav1.ListOptions{Watch: true, ResourceVersion: resourceVersion})
+		if err != nil {
+			glog.Warningln("fail to watch events: " + err.Error())
+			resourceVersion = ""
+			time.Sleep(watchRetryDelay)
+			continue
+		}
+		eventChan := watchEvents.ResultChan()
+		for event := range eventChan {
+			if event.Type == watch.Error {
+				// the resource version is too old, start over
+				resourceVersion = ""
+				continue
+			}
+			e, ok := event.Object.(*v1.Event)
+			if !ok {
+				glog.Errorln("unexpected type when watching events")
+				continue
+			}
+			resourceVersion = e.ResourceVersion
+			if event.Type != watch.Added && event.Type != watch.Modified {
+				continue
+			}
+			if !reasons[e.Reason] || e.LastTimestamp.Time.Before(start) {
+				continue
+			}
+			if !limiter.allow(e.Namespace) {
+				glog.Warningln("annotation of event " + e.Namespace + "/" + e.Name + " dropped by rate limit")
+				continue
+			}
+			kind := strings.ToLower(e.InvolvedObject.Kind)
+			text := e.InvolvedObject.Kind + " " + e.InvolvedObject.Name + ": " + e.Reason + "<br>" + e.Message
+			org, tags := annotationOrg(clientset, e.Namespace, []string{annotationTag, kind, e.Reason})
+			grafanaClient.PostTenantAnnotation(org, e.LastTimestamp.Time, tags, text)
+		}
+		glog.Warningln("watch of events closed, watching again")
+		glog.Flush()
+	}
+}
+
+// watchRolloutAnnotations posts an annotation when the pod template of a deployment or statefulset changes, which starts a rollout
+func watchRolloutAnnotations(clientset *kubernetes.Clientset, grafanaClient *grafana.GrafanaClient, limiter *annotationLimiter) {
+	go watchRollouts(clientset, grafanaClient, limiter, "Deployment", func() (watch.Interface, error) {
+		return clientset.AppsV1().Deployments("").Watch(metav1.ListOptions{Watch: true})
+	}, func(object runtime.Object) (metav1.ObjectMeta, v1.PodTemplateSpec, bool) {
+		d, ok := object.(*appsv1.Deployment)
+		if !ok {
+			return metav1.ObjectMeta{}, v1.PodTemplateSpec{}, false
+		}
+		return d.ObjectMeta, d.Spec.Template, true
+	})
+	watchRollouts(clientset, grafanaClient, limiter, "StatefulSet", func() (watch.Interface, error) {
+		return clientset.AppsV1().StatefulSets("").Watch(metav1.ListOptions{Watch: true})
+	}, func(object runtime.Object) (metav1.ObjectMeta, v1.PodTemplateSpec, bool) {
+		s, ok := object.(*appsv1.StatefulSet)
+		if !ok {
+			return metav1.ObjectMeta{}, v1.PodTemplateSpec{}, false
+		}
+		return s.ObjectMeta, s.Spec.Template, true
+	})
+}
+
+// watchRollouts posts an annotation when the pod template hash of an object of kind changes. Scaling changes the generation but not the template, so it is not a rollout.
+// A closed watch is established again. It starts with the existing objects, so templates changed in between are posted too.
+func watchRollouts(clientset *kubernetes.Clientset, grafanaClient *grafana.GrafanaClient, limiter *annotationLimiter, kind string, watchKind func() (watch.Interface, error), template func(runtime.Object) (metav1.ObjectMeta, v1.PodTemplateSpec, bool)) {
+	templates := make(map[string]string)
+	for {
+		watchObjects, err := watchKind()
+		if err != nil {
+			glog.Warningln("fail to watch " + strings.ToLower(kind) + "s: " + err.Error())
+			time.Sleep(watchRetryDelay)
+			continue
+		}
+		eventChan := watchObjects.ResultChan()
+		for event := range eventChan {
+			meta, spec, ok := template(event.Object)
+			if !ok {
+				continue
+			}
+			key := meta.Namespace + "/" + meta.Name
+			if event.Type == watch.Deleted {
+				delete(templates, key)
+				continue
+			}
+			if event.Type != watch.Added && event.Type != watch.Modified {
+				continue
+			}
+			hash := templateHash(spec)
+			last, ok := templates[key]
+			templates[key] = hash
+			if !ok || hash == last {
+				continue
+			}
+			if !limiter.allow(meta.Namespace) {
+				glog.Warningln("annotation of rollout " + kind + "/" + key + " dropped by rate limit")
+				continue
+			}
+			var images []string
+			for _, container := range spec.Spec.Containers {
+				images = append(images, container.Image)
+			}
+			text := "Rollout of " + kind + " " + meta.Name + " (generation " + strconv.FormatInt(meta.Generation, 10) + ")<br>" + strings.Join(images, ", ")
+			org, tags := annotationOrg(clientset, meta.Namespace, []string{annotationTag, strings.ToLower(kind), "Rollout"})
+			grafanaClient.PostTenantAnnotation(org, time.Now(), tags, text)
+		}
+		glog.Warningln("watch of " + strings.ToLower(kind) + "s closed, watching again")
+		glog.Flush()
+	}
+}
+
+// templateHash hashes a pod template, so a change of it can be told apart from other spec changes
+func templateHash(template v1.PodTemplateSpec) string {
+	data, err := json.Marshal(template)
+	if err != nil {
+		glog.Warningln("fail to marshal pod template: " + err.Error())
+		return ""
+	}
+	hash := fnv.New64a()
+	hash.Write(data)
+	return strconv.FormatUint(hash.Sum64(), 16)
+}
+
+// annotationEventReasons reads ANNOTATION_EVENT_REASONS, a comma separated list of the event reasons posted as annotations
+func annotationEventReasons() []string {
+	reasons := os.Getenv("ANNOTATION_EVENT_REASONS")
+	if reasons == "" {
+		return []string{"Killing", "Evicted", "OOMKilling", "BackOff", "FailedScheduling", "ScalingReplicaSet"}
+	}
+	return strings.Split(reasons, ",")
+}
+
+// annotationRate reads ANNOTATION_RATE, the maximum number of annotations per namespace per minute. The default is 30.
+func annotationRate() int {
+	perMinute, err := strconv.Atoi(os.Getenv("ANNOTATION_RATE"))
+	if err != nil || perMinute < 1 {
+		return 30
+	}
+	return perMinute
+}
+
+// annotationOrg gives the organization annotations of a namespace are posted to. In tenants grouped by label, annotations are also tagged with their namespace.
+func annotationOrg(clientset *kubernetes.Clientset, namespace string, tags []string) (string, []string) {
+	org := orgOf(clientset, namespace)
+	if org != namespace {
+		tags = append(tags, namespace)
+	}
+	return org, tags
+}
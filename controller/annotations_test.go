@@ -0,0 +1,29 @@
+package controller
+
+import (
+	"testing"
+
+	"k8s.io/api/core/v1"
+)
+
+func TestTemplateHash(t *testing.T) {
+	template := func(image string, annotations map[string]string) v1.PodTemplateSpec {
+		spec := v1.PodTemplateSpec{Spec: v1.PodSpec{Containers: []v1.Container{{Name: "app", Image: image}}}}
+		spec.Annotations = annotations
+		return spec
+	}
+	tests := []struct {
+		name        string
+		old, new    v1.PodTemplateSpec
+		wantRollout bool
+	}{
+		{"unchanged", template("app:1", nil), template("app:1", nil), false},
+		{"new image", template("app:1", nil), template("app:2", nil), true},
+		{"restart", template("app:1", nil), template("app:1", map[string]string{"kubectl.kubernetes.io/restartedAt": "2024-01-01T00:00:00Z"}), true},
+	}
+	for _, test := range tests {
+		if got := templateHash(test.old) != templateHash(test.new); got != test.wantRollout {
+			t.Errorf("%s: got rollout %v, want %v", test.name, got, test.wantRollout)
+		}
+	}
+}
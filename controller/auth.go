@@ -0,0 +1,171 @@
+package controller
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"k8s-grafana-controller/grafana"
+	"os"
+	"reflect"
+	"time"
+
+	"github.com/golang/glog"
+	"k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// groupsAnnotation of a namespace maps external groups to org roles, e.g. {"devs": "Editor"}
+const groupsAnnotation = "grafana-controller/groups"
+
+// syncAuthMapping writes the mapping of external groups to org roles to AUTH_MAPPING_TARGET. The groups of a tenant are the
+// groups bound in its namespace and the groups in its groups annotation, which wins.
+func syncAuthMapping(clientset *kubernetes.Clientset, grafanaClient *grafana.GrafanaClient) {
+	if authMappingTarget() == "" {
+		return
+	}
+	tenants, err := listTenants(clientset)
+	if err != nil {
+		glog.Error(err)
+		return
+	}
+	groups := make(map[string]map[string]string)
+	for _, tenant := range tenants {
+		_, bound, err := boundOrgRoles(clientset, tenantMembers(clientset, tenant))
+		if err != nil {
+			glog.Errorln("skip groups of org " + tenant.Name + " in auth mapping: " + err.Error())
+			continue
+		}
+		addOwners(tenant.Name, make(map[string]string), bound)
+		if value := tenant.Annotations[groupsAnnotation]; value != "" {
+			var annotated map[string]string
+			err = json.Unmarshal([]byte(value), &annotated)
+			if err != nil {
+				glog.Warningln("invalid groups annotation of org " + tenant.Name + ": " + err.Error())
+			}
+			for group, role := range annotated {
+				bound[group] = role
+			}
+		}
+		groups[tenant.Name] = bound
+	}
+	mapping := grafanaClient.AuthMapping(groups)
+	data := map[string]string{
+		"org_mapping":        mapping.OrgMapping,
+		"org_attribute_path": authGroupsAttributePath(),
+	}
+	if path := ldapConfig(); path != "" {
+		base, err := ioutil.ReadFile(path)
+		if err != nil {
+			glog.Error(err)
+			return
+		}
+		data["ldap.toml"] = string(base) + "\n" + mapping.LDAPGroupMappings
+	} else {
+		data["ldap-group-mappings.toml"] = mapping.LDAPGroupMappings
+	}
+	err = writeAuthMapping(clientset, data)
+	if err != nil {
+		glog.Errorln("fail to write auth mapping: " + err.Error())
+	}
+}
+
+// authMappingRequests holds a pending request to write the auth mapping, so bursts of changes write it once
+var authMappingRequests = make(chan struct{}, 1)
+
+// requestAuthMapping asks SyncAuthMapping to write the auth mapping again
+func requestAuthMapping() {
+	select {
+	case authMappingRequests <- struct{}{}:
+	default:
+	}
+}
+
+// SyncAuthMapping writes the auth mapping when it is requested, at most once every 10 seconds
+func SyncAuthMapping(clientset *kubernetes.Clientset, grafanaClient *grafana.GrafanaClient) {
+	if authMappingTarget() == "" {
+		return
+	}
+	for range authMappingRequests {
+		time.Sleep(10 * time.Second)
+		syncAuthMapping(clientset, grafanaClient)
+	}
+}
+
+// writeAuthMapping creates or updates the ConfigMap or Secret AUTH_MAPPING_NAME in AUTH_MAPPING_NAMESPACE
+func writeAuthMapping(clientset *kubernetes.Clientset, data map[string]string) error {
+	meta := metav1.ObjectMeta{Name: authMappingName(), Namespace: authMappingNamespace()}
+	switch authMappingTarget() {
+	case "configmap":
+		configMaps := clientset.CoreV1().ConfigMaps(meta.Namespace)
+		cm, err := configMaps.Get(meta.Name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			_, err = configMaps.Create(&v1.ConfigMap{ObjectMeta: meta, Data: data})
+			return err
+		}
+		if err != nil || reflect.DeepEqual(cm.Data, data) {
+			return err
+		}
+		cm.Data = data
+		_, err = configMaps.Update(cm)
+		return err
+	case "secret":
+		secretData := make(map[string][]byte)
+		for key, value := range data {
+			secretData[key] = []byte(value)
+		}
+		secrets := clientset.CoreV1().Secrets(meta.Namespace)
+		secret, err := secrets.Get(meta.Name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			_, err = secrets.Create(&v1.Secret{ObjectMeta: meta, Data: secretData})
+			return err
+		}
+		if err != nil || reflect.DeepEqual(secret.Data, secretData) {
+			return err
+		}
+		secret.Data = secretData
+		_, err = secrets.Update(secret)
+		return err
+	}
+	glog.Warningln("unknown AUTH_MAPPING_TARGET " + authMappingTarget())
+	return nil
+}
+
+// authMappingTarget reads AUTH_MAPPING_TARGET: "configmap" or "secret". The auth mapping is not written if it is empty.
+func authMappingTarget() string {
+	target := os.Getenv("AUTH_MAPPING_TARGET")
+	return target
+}
+
+// authMappingName reads AUTH_MAPPING_NAME. The default is "grafana-auth-mapping".
+func authMappingName() string {
+	name := os.Getenv("AUTH_MAPPING_NAME")
+	if name == "" {
+		return "grafana-auth-mapping"
+	}
+	return name
+}
+
+// authMappingNamespace reads AUTH_MAPPING_NAMESPACE, the namespace grafana runs in. The default is "monitoring".
+func authMappingNamespace() string {
+	namespace := os.Getenv("AUTH_MAPPING_NAMESPACE")
+	if namespace == "" {
+		return "monitoring"
+	}
+	return namespace
+}
+
+// authGroupsAttributePath reads AUTH_GROUPS_ATTRIBUTE_PATH, the JMESPath of the groups in the oauth user info. The default is "groups".
+func authGroupsAttributePath() string {
+	path := os.Getenv("AUTH_GROUPS_ATTRIBUTE_PATH")
+	if path == "" {
+		return "groups"
+	}
+	return path
+}
+
+// ldapConfig reads LDAP_CONFIG, the path of an ldap.toml without group mappings. The group mappings are appended to it.
+func ldapConfig() string {
+	path := os.Getenv("LDAP_CONFIG")
+	return path
+}
@@ -0,0 +1,343 @@
+package controller
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"k8s-grafana-controller/grafana"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// backupLabel marks backups with the namespace of the tenant they belong to
+const backupLabel = "grafana-controller/backup-of"
+
+// pendingDeletesName is the ConfigMap in BACKUP_NAMESPACE that keeps pendingDeletes across restarts of the controller
+const pendingDeletesName = "grafana-controller-pending-deletes"
+
+// pendingDeletes holds the organizations whose backup failed when their last namespace was deleted, so resyncs retry them.
+// It is stored in the ConfigMap pendingDeletesName, so a restart does not forget them.
+var pendingDeletes = struct {
+	sync.Mutex
+	orgs map[string]bool
+}{orgs: make(map[string]bool)}
+
+// deleteTenant backs up the dashboards of a tenant, then deletes the tenant. If the backup fails, the organization is kept
+// and the deletion is retried on the next resync.
+func deleteTenant(clientset *kubernetes.Clientset, grafanaClient *grafana.GrafanaClient, namespace string) {
+	if backupTarget() != "" {
+		err := backupTenant(clientset, grafanaClient, namespace)
+		if err != nil {
+			glog.Errorln("fail to back up org " + namespace + ", org is deleted on a later resync: " + err.Error())
+			setPendingDelete(clientset, namespace, true)
+			return
+		}
+	}
+	grafanaClient.DeleteTenant(namespace)
+	setPendingDelete(clientset, namespace, false)
+	deleteGauges("grafana_controller_datasource_up", "org", namespace)
+	deleteQuotaGauges(namespace)
+}
+
+// retryDeleteTenants deletes again the organizations whose backup failed, unless a namespace joined them meanwhile.
+// The stored pending deletes are read first, so deletions pending before a restart are retried too.
+func retryDeleteTenants(clientset *kubernetes.Clientset, grafanaClient *grafana.GrafanaClient, tenants []grafana.Tenant) {
+	loadPendingDeletes(clientset)
+	pendingDeletes.Lock()
+	var orgs []string
+	for org := range pendingDeletes.orgs {
+		orgs = append(orgs, org)
+	}
+	pendingDeletes.Unlock()
+	for _, org := range orgs {
+		alive := false
+		for _, tenant := range tenants {
+			if tenant.Name == org {
+				alive = true
+				break
+			}
+		}
+		if alive {
+			setPendingDelete(clientset, org, false)
+			continue
+		}
+		deleteTenant(clientset, grafanaClient, org)
+	}
+}
+
+// setPendingDelete adds an organization to pendingDeletes, or removes it, and stores the change
+func setPendingDelete(clientset *kubernetes.Clientset, org string, pending bool) {
+	pendingDeletes.Lock()
+	defer pendingDeletes.Unlock()
+	if pendingDeletes.orgs[org] == pending {
+		return
+	}
+	if pending {
+		pendingDeletes.orgs[org] = true
+	} else {
+		delete(pendingDeletes.orgs, org)
+	}
+	data := make(map[string]string)
+	for org := range pendingDeletes.orgs {
+		data[org] = "true"
+	}
+	if err := writePendingDeletes(clientset, data); err != nil {
+		glog.Warningln("fail to store pending deletes of orgs: " + err.Error())
+	}
+}
+
+// loadPendingDeletes adds the organizations stored in the ConfigMap pendingDeletesName to pendingDeletes
+func loadPendingDeletes(clientset *kubernetes.Clientset) {
+	cm, err := clientset.CoreV1().ConfigMaps(backupNamespace()).Get(pendingDeletesName, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return
+	}
+	if err != nil {
+		glog.Warningln("fail to read pending deletes of orgs: " + err.Error())
+		return
+	}
+	pendingDeletes.Lock()
+	defer pendingDeletes.Unlock()
+	for org := range cm.Data {
+		pendingDeletes.orgs[org] = true
+	}
+}
+
+// writePendingDeletes creates or updates the ConfigMap pendingDeletesName with one key per organization
+func writePendingDeletes(clientset *kubernetes.Clientset, data map[string]string) error {
+	configMaps := clientset.CoreV1().ConfigMaps(backupNamespace())
+	cm, err := configMaps.Get(pendingDeletesName, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		if len(data) == 0 {
+			return nil
+		}
+		_, err = configMaps.Create(&v1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: pendingDeletesName}, Data: data})
+		return err
+	}
+	if err != nil || reflect.DeepEqual(cm.Data, data) {
+		return err
+	}
+	cm.Data = data
+	_, err = configMaps.Update(cm)
+	return err
+}
+
+// backupTenant exports all the dashboards of a tenant to BACKUP_TARGET and removes old backups of the tenant
+func backupTenant(clientset *kubernetes.Clientset, grafanaClient *grafana.GrafanaClient, namespace string) error {
+	dbList, err := grafanaClient.ExportTenant(namespace)
+	if err != nil {
+		return err
+	}
+	if len(dbList) == 0 {
+		return nil
+	}
+	data := make(map[string][]byte)
+	for i, db := range dbList {
+		content, err := json.Marshal(db)
+		if err != nil {
+			return err
+		}
+		uid, _ := db.Model["uid"].(string)
+		if uid == "" {
+			uid = strconv.Itoa(i)
+		}
+		data[uid+".json"] = content
+	}
+	name := "grafana-backup-" + namespace + "-" + time.Now().UTC().Format("20060102-150405")
+	labels := map[string]string{backupLabel: namespace}
+	switch backupTarget() {
+	case "configmap":
+		cm := &v1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: name, Labels: labels}, Data: make(map[string]string)}
+		for key, value := range data {
+			cm.Data[key] = string(value)
+		}
+		_, err = clientset.CoreV1().ConfigMaps(backupNamespace()).Create(cm)
+	case "secret":
+		secret := &v1.Secret{ObjectMeta: metav1.ObjectMeta{Name: name, Labels: labels}, Data: data}
+		_, err = clientset.CoreV1().Secrets(backupNamespace()).Create(secret)
+	case "dir":
+		err = writeBackupDir(filepath.Join(backupDir(), namespace, name), data)
+	default:
+		err = errors.New("unknown BACKUP_TARGET " + backupTarget())
+	}
+	if err != nil {
+		return err
+	}
+	glog.Infoln("org " + namespace + " backed up to " + name)
+	pruneBackups(clientset, namespace)
+	return nil
+}
+
+func writeBackupDir(dir string, data map[string][]byte) error {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return err
+	}
+	for key, value := range data {
+		err = ioutil.WriteFile(filepath.Join(dir, key), value, 0600)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pruneBackups keeps the newest BACKUP_KEEP backups of a tenant and removes backups older than BACKUP_MAX_AGE
+func pruneBackups(clientset *kubernetes.Clientset, namespace string) {
+	type backup struct {
+		name    string
+		created time.Time
+	}
+	var backups []backup
+	options := metav1.ListOptions{LabelSelector: backupLabel + "=" + namespace}
+	switch backupTarget() {
+	case "configmap":
+		list, err := clientset.CoreV1().ConfigMaps(backupNamespace()).List(options)
+		if err != nil {
+			glog.Error(err)
+			return
+		}
+		for _, cm := range list.Items {
+			backups = append(backups, backup{cm.Name, cm.CreationTimestamp.Time})
+		}
+	case "secret":
+		list, err := clientset.CoreV1().Secrets(backupNamespace()).List(options)
+		if err != nil {
+			glog.Error(err)
+			return
+		}
+		for _, secret := range list.Items {
+			backups = append(backups, backup{secret.Name, secret.CreationTimestamp.Time})
+		}
+	case "dir":
+		files, err := ioutil.ReadDir(filepath.Join(backupDir(), namespace))
+		if err != nil {
+			glog.Error(err)
+			return
+		}
+		for _, f := range files {
+			if f.IsDir() {
+				backups = append(backups, backup{f.Name(), f.ModTime()})
+			}
+		}
+	}
+	sort.Slice(backups, func(i, j int) bool { return backups[i].created.After(backups[j].created) })
+	for i, b := range backups {
+		if i < backupKeep() && (backupMaxAge() == 0 || time.Since(b.created) < backupMaxAge()) {
+			continue
+		}
+		var err error
+		switch backupTarget() {
+		case "configmap":
+			err = clientset.CoreV1().ConfigMaps(backupNamespace()).Delete(b.name, &metav1.DeleteOptions{})
+		case "secret":
+			err = clientset.CoreV1().Secrets(backupNamespace()).Delete(b.name, &metav1.DeleteOptions{})
+		case "dir":
+			err = os.RemoveAll(filepath.Join(backupDir(), namespace, b.name))
+		}
+		if err != nil {
+			glog.Error(err)
+		} else {
+			glog.Infoln("backup " + b.name + " removed")
+		}
+	}
+}
+
+// RestoreBackup posts the dashboards of a backup to an organization. name is a directory, or a ConfigMap or Secret in BACKUP_NAMESPACE depending on BACKUP_TARGET.
+func RestoreBackup(clientset *kubernetes.Clientset, grafanaClient *grafana.GrafanaClient, name string, org string) error {
+	if org == "" {
+		return errors.New("organization to restore into is empty")
+	}
+	data := make(map[string][]byte)
+	if info, err := os.Stat(name); err == nil && info.IsDir() {
+		files, err := ioutil.ReadDir(name)
+		if err != nil {
+			return err
+		}
+		for _, f := range files {
+			content, err := ioutil.ReadFile(filepath.Join(name, f.Name()))
+			if err != nil {
+				return err
+			}
+			data[f.Name()] = content
+		}
+	} else if backupTarget() == "secret" {
+		secret, err := clientset.CoreV1().Secrets(backupNamespace()).Get(name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		data = secret.Data
+	} else {
+		cm, err := clientset.CoreV1().ConfigMaps(backupNamespace()).Get(name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		for key, value := range cm.Data {
+			data[key] = []byte(value)
+		}
+	}
+	var dbList []grafana.Dashboard
+	for key, content := range data {
+		var db grafana.Dashboard
+		err := json.Unmarshal(content, &db)
+		if err != nil {
+			glog.Warningln("skip invalid backup entry " + key + ": " + err.Error())
+			continue
+		}
+		dbList = append(dbList, db)
+	}
+	return grafanaClient.RestoreDashboards(org, dbList)
+}
+
+// backupTarget reads BACKUP_TARGET: "configmap", "secret" or "dir". Backups are disabled if it is empty.
+func backupTarget() string {
+	target := os.Getenv("BACKUP_TARGET")
+	return target
+}
+
+// backupNamespace reads BACKUP_NAMESPACE, the namespace of backup ConfigMaps and Secrets. The default is "monitoring".
+func backupNamespace() string {
+	namespace := os.Getenv("BACKUP_NAMESPACE")
+	if namespace == "" {
+		return "monitoring"
+	}
+	return namespace
+}
+
+// backupDir reads BACKUP_DIR, the directory of backups when BACKUP_TARGET is "dir". The default is "/backup".
+func backupDir() string {
+	dir := os.Getenv("BACKUP_DIR")
+	if dir == "" {
+		return "/backup"
+	}
+	return dir
+}
+
+// backupKeep reads BACKUP_KEEP, the number of backups kept per tenant. The default is 3.
+func backupKeep() int {
+	keep, err := strconv.Atoi(os.Getenv("BACKUP_KEEP"))
+	if err != nil || keep < 1 {
+		return 3
+	}
+	return keep
+}
+
+// backupMaxAge reads BACKUP_MAX_AGE, e.g. "720h". Backups are kept regardless of age if it is not set.
+func backupMaxAge() time.Duration {
+	age, err := time.ParseDuration(os.Getenv("BACKUP_MAX_AGE"))
+	if err != nil || age < 0 {
+		return 0
+	}
+	return age
+}
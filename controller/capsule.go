@@ -0,0 +1,146 @@
+package controller
+
+import (
+	"k8s-grafana-controller/grafana"
+	"os"
+	"reflect"
+	"sync"
+
+	"github.com/golang/glog"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+)
+
+// capsuleTenantLabel is set by Capsule on the namespaces of a tenant to the name of the tenant
+const capsuleTenantLabel = "capsule.clastix.io/tenant"
+
+// capsuleOwner is a User or Group owner of a Capsule tenant
+type capsuleOwner struct {
+	Kind string
+	Name string
+}
+
+// owners holds the owners of each Capsule tenant
+var owners = struct {
+	sync.Mutex
+	m map[string][]capsuleOwner
+}{m: make(map[string][]capsuleOwner)}
+
+// WatchCapsuleTenants watches the Tenants of Capsule when CAPSULE_ENABLED is true. Namespaces of a Capsule tenant share
+// an org named after the tenant, and the owners of the tenant are org Admins. Namespaces outside of Capsule tenants get no org.
+func WatchCapsuleTenants(clientset *kubernetes.Clientset, dynamicClient dynamic.Interface, grafanaClient *grafana.GrafanaClient) {
+	if !capsuleEnabled() {
+		return
+	}
+	if label := os.Getenv("TENANT_GROUP_LABEL"); label != "" && label != capsuleTenantLabel {
+		glog.Warningln("TENANT_GROUP_LABEL " + label + " is ignored, since namespaces are grouped by Capsule tenant")
+	}
+	resource := dynamicClient.Resource(capsuleTenantResource())
+	list, err := resource.List(metav1.ListOptions{})
+	if err != nil {
+		glog.Fatal(err)
+	}
+	for i := range list.Items {
+		setOwners(list.Items[i].GetName(), tenantOwners(&list.Items[i]))
+	}
+	go func() {
+		watchTenants, err := resource.Watch(metav1.ListOptions{Watch: true, ResourceVersion: list.GetResourceVersion()})
+		if err != nil {
+			glog.Fatal(err)
+		} else {
+			eventChan := watchTenants.ResultChan()
+			for event := range eventChan {
+				t, ok := event.Object.(*unstructured.Unstructured)
+				if !ok {
+					glog.Errorln("unexpected type when watching capsule tenants")
+					continue
+				}
+				list := tenantOwners(t)
+				if event.Type == watch.Deleted {
+					list = nil
+				}
+				if !setOwners(t.GetName(), list) {
+					continue
+				}
+				glog.Infoln("owners of capsule tenant " + t.GetName() + " changed")
+				tenants, err := listTenants(clientset)
+				if err != nil {
+					glog.Error(err)
+					continue
+				}
+				for _, tenant := range tenants {
+					if tenant.Name == t.GetName() {
+						syncTenantRoles(clientset, grafanaClient, tenant)
+					}
+				}
+				requestAuthMapping()
+			}
+		}
+		glog.Flush()
+	}()
+}
+
+// tenantOwners reads the User and Group owners of a Capsule tenant
+func tenantOwners(t *unstructured.Unstructured) []capsuleOwner {
+	items, _, _ := unstructured.NestedSlice(t.Object, "spec", "owners")
+	var list []capsuleOwner
+	for _, item := range items {
+		owner, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		kind, _ := owner["kind"].(string)
+		name, _ := owner["name"].(string)
+		if (kind == "User" || kind == "Group") && name != "" {
+			list = append(list, capsuleOwner{Kind: kind, Name: name})
+		}
+	}
+	return list
+}
+
+// setOwners sets the owners of a Capsule tenant, and tells whether they changed
+func setOwners(tenant string, list []capsuleOwner) bool {
+	owners.Lock()
+	defer owners.Unlock()
+	if reflect.DeepEqual(owners.m[tenant], list) {
+		return false
+	}
+	if list == nil {
+		delete(owners.m, tenant)
+	} else {
+		owners.m[tenant] = list
+	}
+	return true
+}
+
+// addOwners makes the owners of the Capsule tenant of an org Admins
+func addOwners(org string, users map[string]string, groups map[string]string) {
+	owners.Lock()
+	defer owners.Unlock()
+	for _, owner := range owners.m[org] {
+		if owner.Kind == "User" {
+			users[owner.Name] = "Admin"
+		} else {
+			groups[owner.Name] = "Admin"
+		}
+	}
+}
+
+// capsuleTenantResource gives the Tenant resource of CAPSULE_API_VERSION, which defaults to "v1beta2"
+func capsuleTenantResource() schema.GroupVersionResource {
+	version := os.Getenv("CAPSULE_API_VERSION")
+	if version == "" {
+		version = "v1beta2"
+	}
+	return schema.GroupVersionResource{Group: "capsule.clastix.io", Version: version, Resource: "tenants"}
+}
+
+// capsuleEnabled reads CAPSULE_ENABLED. Capsule tenants are the tenants of the controller if it is "true".
+func capsuleEnabled() bool {
+	enabled := os.Getenv("CAPSULE_ENABLED")
+	return enabled == "true"
+}
@@ -7,6 +7,7 @@ import (
 	"os"
 	"path/filepath"
 	"regexp"
+	"time"
 
 	"github.com/golang/glog"
 	"k8s.io/api/core/v1"
@@ -16,9 +17,11 @@ import (
 	"k8s.io/client-go/tools/clientcmd"
 )
 
+// kubeconfig is the path of the kubeconfig file, also used by the dynamic client
+var kubeconfig *string
+
 // InitClientSet initiates a client to interact with kubernetes
 func InitClientSet() (*kubernetes.Clientset, error) {
-	var kubeconfig *string
 	configPath := pathToConfig()
 	kubeconfig = flag.String("kubeconfig", filepath.Join(configPath, "config"), "(optional) absolute path to the kubeconfig file")
 	flag.Parse()
@@ -37,9 +40,18 @@ func InitClientSet() (*kubernetes.Clientset, error) {
 	return clientset, nil
 }
 
-//InitGrafanaClient initiates a client to interact with grafana
-func InitGrafanaClient() (*grafana.GrafanaClient, error) {
-	grafanaClient, err := grafana.NewGrafanaClient(grafanaIP(), adminName(), adminPassword())
+//InitGrafanaClient initiates a client to interact with grafana. Grafana and prometheus are found by their services if GRAFANA_SERVICE and PROMETHEUS_SERVICE are set, or else by GRAFANA_IP and PROMETHEUS_IP.
+func InitGrafanaClient(clientset *kubernetes.Clientset) (*grafana.GrafanaClient, error) {
+	grafana.SetSecretReader(secretReader(clientset))
+	grafana.SetViewerPasswordReader(viewerPasswordReader(clientset))
+	address, err := resolveServices(clientset)
+	if err != nil {
+		return nil, err
+	}
+	if address == "" {
+		address = grafanaIP()
+	}
+	grafanaClient, err := grafana.NewGrafanaClient(address, adminName(), adminPassword())
 	if err != nil {
 		return nil, err
 	}
@@ -47,22 +59,31 @@ func InitGrafanaClient() (*grafana.GrafanaClient, error) {
 }
 
 func InitControllerClient(admin *grafana.GrafanaClient) (*grafana.GrafanaClient, error) {
-	admin.PostUser("grafana-controller", admin.GrafanaIP)
-	id := admin.GetUserID("grafana-controller", admin.GrafanaIP)
-	if id == 0 {
-		return nil, errors.New("fail to post grafana controller")
+	err := postControllerUser(admin)
+	if err != nil {
+		return nil, err
 	}
-	admin.PutUserPermissionToAdmin(id, admin.GrafanaIP)
-	admin.PutUserPassword(id, admin.GrafanaIP, "grafanaControllerPassword12345")
-	controllerClient, err := grafana.NewGrafanaClient(admin.GrafanaIP, "grafana-controller", "grafanaControllerPassword12345")
+	controllerClient, err := grafana.NewGrafanaClient(admin.GetGrafanaIP(), "grafana-controller", "grafanaControllerPassword12345")
 	if err != nil {
 		return nil, err
 	}
 	return controllerClient, nil
 }
 
+// postControllerUser creates the grafana-controller user as a grafana admin, or resets it when grafana lost it
+func postControllerUser(admin *grafana.GrafanaClient) error {
+	admin.PostUser("grafana-controller", admin.GetGrafanaIP())
+	id := admin.GetUserID("grafana-controller", admin.GetGrafanaIP())
+	if id == 0 {
+		return errors.New("fail to post grafana controller")
+	}
+	admin.PutUserPermissionToAdmin(id, admin.GetGrafanaIP())
+	admin.PutUserPassword(id, admin.GetGrafanaIP(), "grafanaControllerPassword12345")
+	return nil
+}
+
 // WatchGrafana watches the grafana pod. If the pod is deleted, post existing tenants to ensure correctness
-func WatchGrafana(clientset *kubernetes.Clientset, grafanaClient *grafana.GrafanaClient) {
+func WatchGrafana(clientset *kubernetes.Clientset, grafanaClient *grafana.GrafanaClient, controllerClient *grafana.GrafanaClient) {
 
 	watchGrafana, err := clientset.CoreV1().Pods("monitoring").Watch(metav1.ListOptions{Watch: true})
 	if err != nil {
@@ -77,7 +98,7 @@ func WatchGrafana(clientset *kubernetes.Clientset, grafanaClient *grafana.Grafan
 			} else {
 				switch event.Type {
 				case watch.Deleted:
-					controllerClient, err := InitControllerClient(grafanaClient)
+					err := postControllerUser(grafanaClient)
 					if err != nil {
 						glog.Error("can not init controllerClient")
 					}
@@ -85,16 +106,18 @@ func WatchGrafana(clientset *kubernetes.Clientset, grafanaClient *grafana.Grafan
 					pattern := "^kube-prometheus-grafana[0-9a-z-]+"
 					match, _ := regexp.Match(pattern, []byte(pod.Name))
 					if match {
-						namespaces, err := clientset.CoreV1().Namespaces().List(metav1.ListOptions{})
+						tenants, err := listTenants(clientset)
 						if err != nil {
 							glog.Error(err)
 						}
-						if len(namespaces.Items) == 0 {
+						if len(tenants) == 0 {
 							glog.Warning("No namespaces found")
 						} else {
-							for _, namespace := range namespaces.Items {
-								controllerClient.PostTenant(namespace.Name, dbList)
-								glog.Infoln("namespace " + namespace.Name + " added")
+							for _, tenant := range tenants {
+								controllerClient.PostTenant(tenant, dbList)
+								reportQuotas(controllerClient, tenant.Name)
+								syncTenantRoles(clientset, controllerClient, tenant)
+								glog.Infoln("tenant " + tenant.Name + " added")
 							}
 						}
 					}
@@ -110,13 +133,37 @@ func WatchGrafana(clientset *kubernetes.Clientset, grafanaClient *grafana.Grafan
 }
 
 // WatchTenants watches namespaces of kubernetes. If a new namespace is created, add tenant accordingly.
+// Existing namespaces are synced once per tenant, and the watch starts after them.
 func WatchTenants(clientset *kubernetes.Clientset, grafanaClient *grafana.GrafanaClient) {
+	namespaces, err := clientset.CoreV1().Namespaces().List(metav1.ListOptions{})
+	if err != nil {
+		glog.Fatal(err)
+	}
+	dbList := grafanaClient.GetDashboardList()
+	// orgs holds the organization of each namespace, to notice namespaces moving between tenants grouped by label
+	orgs := make(map[string]membership)
+	tenants := groupTenants(namespaces.Items)
+	for _, tenant := range tenants {
+		for _, ns := range memberNamespacesOf(tenant, namespaces.Items) {
+			orgs[ns.Name] = membershipOf(ns)
+		}
+	}
+	for _, tenant := range tenants {
+		grafanaClient.PostTenant(tenant, dbList)
+		reportQuotas(grafanaClient, tenant.Name)
+		postNamespaceConfigMapDashboards(clientset, grafanaClient, tenant)
+		syncTenantRoles(clientset, grafanaClient, tenant)
+		glog.Infoln("tenant " + tenant.Name + " synced")
+	}
+	for i := range namespaces.Items {
+		syncAPIToken(clientset, grafanaClient, &namespaces.Items[i])
+	}
+	syncAuthMapping(clientset, grafanaClient)
 	var watchns watch.Interface
-	watchns, err := clientset.CoreV1().Namespaces().Watch(metav1.ListOptions{Watch: true})
+	watchns, err = clientset.CoreV1().Namespaces().Watch(metav1.ListOptions{Watch: true, ResourceVersion: namespaces.ResourceVersion})
 	if err != nil {
 		glog.Fatal(err)
 	} else {
-		dbList := grafanaClient.GetDashboardList()
 		eventChan := watchns.ResultChan()
 		for event := range eventChan {
 			ns, ok := event.Object.(*v1.Namespace)
@@ -125,10 +172,59 @@ func WatchTenants(clientset *kubernetes.Clientset, grafanaClient *grafana.Grafan
 			} else {
 				switch event.Type {
 				case watch.Added:
-					grafanaClient.PostTenant(ns.Name, dbList)
-					glog.Infoln("namespace " + ns.Name + " added")
+					tenant, ok := tenantOf(clientset, ns)
+					if !ok {
+						continue
+					}
+					evictUngrouped(clientset, grafanaClient, orgs, tenant, dbList)
+					orgs[ns.Name] = membershipOf(ns)
+					grafanaClient.PostTenant(tenant, dbList)
+					reportQuotas(grafanaClient, tenant.Name)
+					postNamespaceConfigMapDashboards(clientset, grafanaClient, tenant)
+					syncTenantRoles(clientset, grafanaClient, tenant)
+					requestAuthMapping()
+					syncAPIToken(clientset, grafanaClient, ns)
+					glog.Infoln("namespace " + ns.Name + " added to org " + tenant.Name)
+				case watch.Modified:
+					previous, ok := orgs[ns.Name]
+					if ok && previous == membershipOf(ns) {
+						syncAPIToken(clientset, grafanaClient, ns)
+						continue
+					}
+					if ok {
+						// the namespace leaves first, so the users of the old org are not carried into the new one
+						delete(orgs, ns.Name)
+						if ns.Annotations[apiTokenAnnotation] != "" {
+							revokeAPIToken(clientset, grafanaClient, ns.Name, previous.org)
+						}
+						leaveTenant(clientset, grafanaClient, ns.Name, previous.org, dbList)
+						requestAuthMapping()
+						glog.Infoln("namespace " + ns.Name + " left org " + previous.org)
+					}
+					tenant, joined := tenantOf(clientset, ns)
+					if !joined {
+						continue
+					}
+					evictUngrouped(clientset, grafanaClient, orgs, tenant, dbList)
+					orgs[ns.Name] = membershipOf(ns)
+					grafanaClient.PostTenant(tenant, dbList)
+					reportQuotas(grafanaClient, tenant.Name)
+					postNamespaceConfigMapDashboards(clientset, grafanaClient, tenant)
+					syncTenantRoles(clientset, grafanaClient, tenant)
+					syncAPIToken(clientset, grafanaClient, ns)
+					requestAuthMapping()
+					glog.Infoln("namespace " + ns.Name + " joined org " + tenant.Name)
 				case watch.Deleted:
-					grafanaClient.DeleteTenant(ns.Name)
+					previous, ok := orgs[ns.Name]
+					if !ok {
+						continue
+					}
+					delete(orgs, ns.Name)
+					if ns.Annotations[apiTokenAnnotation] != "" {
+						grafanaClient.RevokeTenantToken(previous.org, serviceAccountName(ns.Name))
+					}
+					leaveTenant(clientset, grafanaClient, ns.Name, previous.org, dbList)
+					requestAuthMapping()
 					glog.Infoln("namespace " + ns.Name + " deleted")
 				case watch.Error:
 					glog.Infoln("namespace " + ns.Name + " has an error")
@@ -139,6 +235,30 @@ func WatchTenants(clientset *kubernetes.Clientset, grafanaClient *grafana.Grafan
 	glog.Flush()
 }
 
+// ResyncTenants periodically reads the template dashboards again and posts them and the ConfigMap dashboards to every tenant, so changes of the templates and their folders reach existing organizations.
+func ResyncTenants(clientset *kubernetes.Clientset, grafanaClient *grafana.GrafanaClient) {
+	for range time.Tick(resyncInterval()) {
+		resyncTenants(clientset, grafanaClient)
+	}
+}
+
+func resyncTenants(clientset *kubernetes.Clientset, grafanaClient *grafana.GrafanaClient) {
+	dbList := grafanaClient.GetDashboardList()
+	tenants, err := listTenants(clientset)
+	if err != nil {
+		glog.Error(err)
+		return
+	}
+	for _, tenant := range tenants {
+		grafanaClient.PostTenantDashboards(tenant, dbList)
+		postNamespaceConfigMapDashboards(clientset, grafanaClient, tenant)
+		reportQuotas(grafanaClient, tenant.Name)
+	}
+	retryDeleteTenants(clientset, grafanaClient, tenants)
+	syncAuthMapping(clientset, grafanaClient)
+	glog.Flush()
+}
+
 func grafanaIP() string {
 	ip := os.Getenv("GRAFANA_IP")
 	return ip
@@ -158,3 +278,12 @@ func adminPassword() string {
 	password := os.Getenv("ADMIN_PASSWORD")
 	return password
 }
+
+// resyncInterval reads RESYNC_INTERVAL, e.g. "10m". The default is 5 minutes.
+func resyncInterval() time.Duration {
+	interval, err := time.ParseDuration(os.Getenv("RESYNC_INTERVAL"))
+	if err != nil || interval <= 0 {
+		return 5 * time.Minute
+	}
+	return interval
+}
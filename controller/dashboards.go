@@ -0,0 +1,85 @@
+package controller
+
+import (
+	"k8s-grafana-controller/grafana"
+	"os"
+	"strings"
+
+	"github.com/golang/glog"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+)
+
+// folderAnnotation on a dashboard ConfigMap chooses the folder its dashboards are put in
+const folderAnnotation = "grafana_folder"
+
+// WatchDashboardConfigMaps watches ConfigMaps labeled as grafana dashboards in all namespaces, and posts their dashboards to the organization of the namespace.
+func WatchDashboardConfigMaps(clientset *kubernetes.Clientset, grafanaClient *grafana.GrafanaClient) {
+	watchcm, err := clientset.CoreV1().ConfigMaps("").Watch(metav1.ListOptions{Watch: true, LabelSelector: dashboardLabel()})
+	if err != nil {
+		glog.Fatal(err)
+	} else {
+		eventChan := watchcm.ResultChan()
+		for event := range eventChan {
+			cm, ok := event.Object.(*v1.ConfigMap)
+			if !ok {
+				glog.Errorln("unexpected type when watching configmaps")
+			} else {
+				switch event.Type {
+				case watch.Added, watch.Modified:
+					ns, err := clientset.CoreV1().Namespaces().Get(cm.Namespace, metav1.GetOptions{})
+					if err != nil {
+						glog.Error(err)
+						continue
+					}
+					tenant, ok := tenantOf(clientset, ns)
+					if !ok {
+						continue
+					}
+					postConfigMapDashboards(clientset, grafanaClient, tenant, cm)
+					glog.Infoln("dashboards of configmap " + cm.Namespace + "/" + cm.Name + " posted")
+				case watch.Deleted:
+					grafanaClient.DeleteConfigMapDashboards(orgOf(clientset, cm.Namespace), cm.Namespace, cm.Name)
+					glog.Infoln("dashboards of configmap " + cm.Namespace + "/" + cm.Name + " deleted")
+				case watch.Error:
+					glog.Infoln("configmap " + cm.Namespace + "/" + cm.Name + " has an error")
+				}
+			}
+		}
+	}
+	glog.Flush()
+}
+
+// postNamespaceConfigMapDashboards posts the dashboards of all the labeled ConfigMaps in the namespaces of a tenant
+func postNamespaceConfigMapDashboards(clientset *kubernetes.Clientset, grafanaClient *grafana.GrafanaClient, tenant grafana.Tenant) {
+	for _, namespace := range tenantMembers(clientset, tenant) {
+		configMaps, err := clientset.CoreV1().ConfigMaps(namespace).List(metav1.ListOptions{LabelSelector: dashboardLabel()})
+		if err != nil {
+			glog.Error(err)
+			continue
+		}
+		for i := range configMaps.Items {
+			postConfigMapDashboards(clientset, grafanaClient, tenant, &configMaps.Items[i])
+		}
+	}
+}
+
+// postConfigMapDashboards posts the dashboards of a ConfigMap, and reports invalid dashboards as events of the ConfigMap
+func postConfigMapDashboards(clientset *kubernetes.Clientset, grafanaClient *grafana.GrafanaClient, tenant grafana.Tenant, cm *v1.ConfigMap) {
+	invalid := grafanaClient.PostConfigMapDashboards(tenant, cm.Namespace, cm.Name, cm.Annotations[folderAnnotation], cm.Data)
+	for key, problems := range invalid {
+		object := v1.ObjectReference{Kind: "ConfigMap", APIVersion: "v1", Namespace: cm.Namespace, Name: cm.Name, UID: cm.UID}
+		recordEvent(clientset, object, v1.EventTypeWarning, "InvalidDashboard", "dashboard "+key+" is not posted: "+strings.Join(problems, "; "))
+	}
+}
+
+// dashboardLabel reads DASHBOARD_LABEL, the label selector of dashboard ConfigMaps. The default is "grafana_dashboard".
+func dashboardLabel() string {
+	label := os.Getenv("DASHBOARD_LABEL")
+	if label == "" {
+		return "grafana_dashboard"
+	}
+	return label
+}
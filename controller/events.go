@@ -0,0 +1,31 @@
+package controller
+
+import (
+	"github.com/golang/glog"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// recordEvent creates an event on a kubernetes object, so tenants can see what the controller did with their objects
+func recordEvent(clientset *kubernetes.Clientset, object v1.ObjectReference, eventType string, reason string, message string) {
+	now := metav1.Now()
+	event := &v1.Event{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: object.Name + ".",
+			Namespace:    object.Namespace,
+		},
+		InvolvedObject: object,
+		Reason:         reason,
+		Message:        message,
+		Type:           eventType,
+		Source:         v1.EventSource{Component: "grafana-controller"},
+		FirstTimestamp: now,
+		LastTimestamp:  now,
+		Count:          1,
+	}
+	_, err := clientset.CoreV1().Events(object.Namespace).Create(event)
+	if err != nil {
+		glog.Error(err)
+	}
+}
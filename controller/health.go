@@ -0,0 +1,94 @@
+package controller
+
+import (
+	"encoding/json"
+	"k8s-grafana-controller/grafana"
+	"os"
+	"reflect"
+	"time"
+
+	"github.com/golang/glog"
+	"k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// statusAnnotation of a namespace holds the status of its organization, e.g. {"datasources": {"prometheus": {"status": "OK"}}}
+const statusAnnotation = "grafana-controller/status"
+
+// tenantStatus is kept in the status annotation of a tenant namespace
+type tenantStatus struct {
+	DataSources map[string]grafana.DataSourceHealth `json:"datasources,omitempty"`
+}
+
+// CheckDataSources periodically runs the health check of the data sources of every tenant. Results are exposed as the
+// grafana_controller_datasource_up metric of the org, and in the status annotation of the namespaces of the tenant, and
+// changes are reported as events of these namespaces.
+func CheckDataSources(clientset *kubernetes.Clientset, grafanaClient *grafana.GrafanaClient) {
+	interval := healthCheckInterval()
+	if interval == 0 {
+		return
+	}
+	for range time.Tick(interval) {
+		tenants, err := listTenants(clientset)
+		if err != nil {
+			glog.Error(err)
+			continue
+		}
+		for _, tenant := range tenants {
+			checkTenantDataSources(clientset, grafanaClient, tenant)
+		}
+		glog.Flush()
+	}
+}
+
+func checkTenantDataSources(clientset *kubernetes.Clientset, grafanaClient *grafana.GrafanaClient, tenant grafana.Tenant) {
+	results := grafanaClient.CheckTenantDataSources(tenant)
+	if results == nil {
+		return
+	}
+	for name, health := range results {
+		up := 0.0
+		if health.Status == "OK" {
+			up = 1
+		}
+		setGauge("grafana_controller_datasource_up", "Whether the grafana health check of a tenant data source succeeds.", up, "org", tenant.Name, "datasource", name)
+	}
+	members, err := memberNamespaces(clientset, tenantMembers(clientset, tenant))
+	if err != nil {
+		glog.Error(err)
+		return
+	}
+	for _, ns := range members {
+		var previous tenantStatus
+		if value := ns.Annotations[statusAnnotation]; value != "" {
+			_ = json.Unmarshal([]byte(value), &previous)
+		}
+		object := v1.ObjectReference{Kind: "Namespace", APIVersion: "v1", Name: ns.Name, UID: ns.UID}
+		for name, health := range results {
+			if last, ok := previous.DataSources[name]; ok && last.Status == health.Status {
+				continue
+			}
+			if health.Status == "OK" {
+				recordEvent(clientset, object, v1.EventTypeNormal, "DataSourceHealthy", "data source "+name+" is healthy")
+			} else {
+				recordEvent(clientset, object, v1.EventTypeWarning, "DataSourceUnhealthy", "data source "+name+" check failed: "+health.Message)
+			}
+		}
+		if !reflect.DeepEqual(previous.DataSources, results) {
+			setNamespaceAnnotation(clientset, ns.Name, statusAnnotation, tenantStatus{DataSources: results})
+		}
+	}
+}
+
+// healthCheckInterval reads HEALTH_CHECK_INTERVAL, e.g. "1m". The default is 1 minute, and "0" turns the checks off.
+func healthCheckInterval() time.Duration {
+	value := os.Getenv("HEALTH_CHECK_INTERVAL")
+	if value == "" {
+		return time.Minute
+	}
+	interval, err := time.ParseDuration(value)
+	if err != nil || interval < 0 {
+		return time.Minute
+	}
+	return interval
+}
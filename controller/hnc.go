@@ -0,0 +1,163 @@
+package controller
+
+import (
+	"k8s-grafana-controller/grafana"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/golang/glog"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// subnamespaceOfAnnotation is set by HNC on subnamespaces to the name of their parent
+const subnamespaceOfAnnotation = "hnc.x-k8s.io/subnamespace-of"
+
+// parents holds the parent of each namespace in the HNC hierarchy, read from HierarchyConfigurations
+var parents = struct {
+	sync.Mutex
+	m map[string]string
+}{m: make(map[string]string)}
+
+// InitDynamicClient initiates a client to read custom resources such as HNC HierarchyConfigurations
+func InitDynamicClient() (dynamic.Interface, error) {
+	config, err := clientcmd.BuildConfigFromFlags("", *kubeconfig)
+	if err != nil {
+		return nil, err
+	}
+	return dynamic.NewForConfig(config)
+}
+
+// WatchHierarchy watches the HierarchyConfigurations of HNC when HNC_ENABLED is true. The org of a namespace shows its
+// descendants too, and the dashboards of every tenant are posted again when the tree changes.
+func WatchHierarchy(clientset *kubernetes.Clientset, dynamicClient dynamic.Interface, grafanaClient *grafana.GrafanaClient) {
+	if !hncEnabled() {
+		return
+	}
+	resource := dynamicClient.Resource(hierarchyResource())
+	list, err := resource.List(metav1.ListOptions{})
+	if err != nil {
+		glog.Fatal(err)
+	}
+	for _, item := range list.Items {
+		setParent(item.GetNamespace(), hierarchyParent(&item))
+	}
+	go func() {
+		watchhc, err := resource.Watch(metav1.ListOptions{Watch: true, ResourceVersion: list.GetResourceVersion()})
+		if err != nil {
+			glog.Fatal(err)
+		} else {
+			eventChan := watchhc.ResultChan()
+			for event := range eventChan {
+				hc, ok := event.Object.(*unstructured.Unstructured)
+				if !ok {
+					glog.Errorln("unexpected type when watching hierarchyconfigurations")
+					continue
+				}
+				parent := hierarchyParent(hc)
+				if event.Type == watch.Deleted {
+					parent = ""
+				}
+				if !setParent(hc.GetNamespace(), parent) {
+					continue
+				}
+				glog.Infoln("parent of namespace " + hc.GetNamespace() + " changed to " + parent + ", updating tenants")
+				resyncTenants(clientset, grafanaClient)
+			}
+		}
+		glog.Flush()
+	}()
+}
+
+// hierarchyParent reads the parent of a HierarchyConfiguration
+func hierarchyParent(hc *unstructured.Unstructured) string {
+	parent, _, _ := unstructured.NestedString(hc.Object, "spec", "parent")
+	return parent
+}
+
+// setParent sets the parent of a namespace, and tells whether it changed
+func setParent(namespace string, parent string) bool {
+	parents.Lock()
+	defer parents.Unlock()
+	if parents.m[namespace] == parent {
+		return false
+	}
+	if parent == "" {
+		delete(parents.m, namespace)
+	} else {
+		parents.m[namespace] = parent
+	}
+	return true
+}
+
+// addDescendants adds the HNC descendants of the namespaces of each tenant to the tenant
+func addDescendants(tenants []grafana.Tenant, namespaces []v1.Namespace) {
+	children := make(map[string][]string)
+	parents.Lock()
+	for child, parent := range parents.m {
+		children[parent] = append(children[parent], child)
+	}
+	parents.Unlock()
+	for _, ns := range namespaces {
+		if parent := ns.Annotations[subnamespaceOfAnnotation]; parent != "" && !containsString(children[parent], ns.Name) {
+			children[parent] = append(children[parent], ns.Name)
+		}
+	}
+	for i := range tenants {
+		members := tenants[i].NamespaceList()
+		seen := make(map[string]bool)
+		for _, namespace := range members {
+			seen[namespace] = true
+		}
+		var descendants []string
+		queue := append([]string{}, members...)
+		for len(queue) > 0 {
+			namespace := queue[0]
+			queue = queue[1:]
+			for _, child := range children[namespace] {
+				if seen[child] {
+					continue
+				}
+				seen[child] = true
+				descendants = append(descendants, child)
+				queue = append(queue, child)
+			}
+		}
+		if len(descendants) == 0 {
+			continue
+		}
+		sort.Strings(descendants)
+		tenants[i].Namespaces = append(append([]string{}, members...), descendants...)
+	}
+}
+
+func containsString(list []string, value string) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// hierarchyResource gives the HierarchyConfiguration resource of HNC_API_VERSION, which defaults to "v1alpha2"
+func hierarchyResource() schema.GroupVersionResource {
+	version := os.Getenv("HNC_API_VERSION")
+	if version == "" {
+		version = "v1alpha2"
+	}
+	return schema.GroupVersionResource{Group: "hnc.x-k8s.io", Version: version, Resource: "hierarchyconfigurations"}
+}
+
+// hncEnabled reads HNC_ENABLED. The orgs of HNC parent namespaces show their descendants if it is "true".
+func hncEnabled() bool {
+	enabled := os.Getenv("HNC_ENABLED")
+	return enabled == "true"
+}
@@ -0,0 +1,89 @@
+package controller
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/golang/glog"
+)
+
+// gauges holds the metrics of the controller in the prometheus text format, by metric name and labels
+var gauges = struct {
+	sync.Mutex
+	help   map[string]string
+	values map[string]map[string]float64
+}{help: make(map[string]string), values: make(map[string]map[string]float64)}
+
+// setGauge sets the value of a gauge with labels given as name, value pairs
+func setGauge(name string, help string, value float64, labels ...string) {
+	var pairs []string
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, labels[i]+"="+labelValue(labels[i+1]))
+	}
+	gauges.Lock()
+	defer gauges.Unlock()
+	gauges.help[name] = help
+	if gauges.values[name] == nil {
+		gauges.values[name] = make(map[string]float64)
+	}
+	gauges.values[name]["{"+strings.Join(pairs, ",")+"}"] = value
+}
+
+// labelEscaper escapes label values as the prometheus text format does: only backslash, double quote and new line
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// labelValue quotes a label value for the prometheus text format
+func labelValue(value string) string {
+	return `"` + labelEscaper.Replace(value) + `"`
+}
+
+// deleteGauges removes the values of a gauge whose labels contain the given label
+func deleteGauges(name string, label string, value string) {
+	gauges.Lock()
+	defer gauges.Unlock()
+	for labels := range gauges.values[name] {
+		if strings.Contains(labels, label+"="+labelValue(value)) {
+			delete(gauges.values[name], labels)
+		}
+	}
+}
+
+// ServeMetrics serves the metrics on METRICS_ADDR, which defaults to ":8080"
+func ServeMetrics() {
+	http.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		gauges.Lock()
+		defer gauges.Unlock()
+		var names []string
+		for name := range gauges.values {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", name, gauges.help[name], name)
+			var series []string
+			for labels := range gauges.values[name] {
+				series = append(series, labels)
+			}
+			sort.Strings(series)
+			for _, labels := range series {
+				fmt.Fprintf(w, "%s%s %v\n", name, labels, gauges.values[name][labels])
+			}
+		}
+	})
+	err := http.ListenAndServe(metricsAddr(), nil)
+	if err != nil {
+		glog.Error(err)
+	}
+}
+
+func metricsAddr() string {
+	addr := os.Getenv("METRICS_ADDR")
+	if addr == "" {
+		return ":8080"
+	}
+	return addr
+}
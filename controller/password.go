@@ -0,0 +1,162 @@
+package controller
+
+import (
+	"k8s-grafana-controller/grafana"
+	"os"
+	"time"
+
+	"github.com/golang/glog"
+	"k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// rotatePasswordAnnotation on a namespace forces the rotation of its viewer password. It is removed after the rotation.
+const rotatePasswordAnnotation = "grafana-controller/rotate-password"
+
+// rotatedAtAnnotation of a viewer secret is the time the password was last rotated
+const rotatedAtAnnotation = "grafana-controller/rotated-at"
+
+// viewerPasswordReader reads the password of a tenant viewer from the viewer secret in its namespace
+func viewerPasswordReader(clientset *kubernetes.Clientset) func(namespace string) (string, error) {
+	return func(namespace string) (string, error) {
+		secret, err := clientset.CoreV1().Secrets(namespace).Get(viewerSecretName(), metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			return "", nil
+		}
+		if err != nil {
+			return "", err
+		}
+		return string(secret.Data["password"]), nil
+	}
+}
+
+// RotateViewerPasswords checks every minute which viewer passwords are due, and rotates them. A password is due if it is
+// older than PASSWORD_ROTATION_INTERVAL, or if a namespace of the tenant has the rotate-password annotation.
+func RotateViewerPasswords(clientset *kubernetes.Clientset, grafanaClient *grafana.GrafanaClient) {
+	for range time.Tick(time.Minute) {
+		namespaces, err := clientset.CoreV1().Namespaces().List(metav1.ListOptions{})
+		if err != nil {
+			glog.Error(err)
+			continue
+		}
+		for _, tenant := range groupTenants(namespaces.Items) {
+			rotateViewerPassword(clientset, grafanaClient, tenant.Name, memberNamespacesOf(tenant, namespaces.Items))
+		}
+		glog.Flush()
+	}
+}
+
+// rotateViewerPassword rotates the viewer password of an organization if it is due, and stores it in the viewer secret of
+// each namespace of the tenant. The last rotation is the newest one found in the secrets. Namespaces whose secret is
+// missing or was not updated by the last rotation get the current password from the newest secret, without a rotation.
+func rotateViewerPassword(clientset *kubernetes.Clientset, grafanaClient *grafana.GrafanaClient, org string, namespaces []*v1.Namespace) {
+	forced := false
+	for _, ns := range namespaces {
+		if _, ok := ns.Annotations[rotatePasswordAnnotation]; ok {
+			forced = true
+		}
+	}
+	secrets := make(map[string]*v1.Secret)
+	var newest *v1.Secret
+	var newestAt time.Time
+	for _, ns := range namespaces {
+		secret, err := clientset.CoreV1().Secrets(ns.Name).Get(viewerSecretName(), metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			glog.Error(err)
+			return
+		}
+		secrets[ns.Name] = secret
+		rotatedAt, err := time.Parse(time.RFC3339, secret.Annotations[rotatedAtAnnotation])
+		if err == nil && (newest == nil || rotatedAt.After(newestAt)) {
+			newest, newestAt = secret, rotatedAt
+		}
+	}
+	interval := passwordRotationInterval()
+	if !forced && (interval == 0 || (newest != nil && time.Since(newestAt) < interval)) {
+		if newest != nil {
+			syncViewerSecrets(clientset, org, namespaces, secrets, string(newest.Data["password"]), newest.Annotations[rotatedAtAnnotation])
+		}
+		return
+	}
+	password, err := grafanaClient.RotateViewerPassword(org)
+	if err != nil {
+		glog.Error(err)
+		return
+	}
+	now := time.Now().UTC().Format(time.RFC3339)
+	for _, ns := range namespaces {
+		err = storeViewerPassword(clientset, ns.Name, org, password, now)
+		if err != nil {
+			glog.Errorln("fail to store viewer password of " + org + " in namespace " + ns.Name + ", it is stored again in a minute: " + err.Error())
+		} else {
+			object := v1.ObjectReference{Kind: "Namespace", APIVersion: "v1", Name: ns.Name, UID: ns.UID}
+			recordEvent(clientset, object, v1.EventTypeNormal, "PasswordRotated", "password of viewer "+org+" rotated and stored in secret "+viewerSecretName())
+		}
+		if _, ok := ns.Annotations[rotatePasswordAnnotation]; ok {
+			removeNamespaceAnnotation(clientset, ns.Name, rotatePasswordAnnotation)
+		}
+	}
+	glog.Infoln("password of viewer " + org + " rotated")
+}
+
+// syncViewerSecrets stores the current viewer password in the namespaces whose secret is missing or older than rotatedAt
+func syncViewerSecrets(clientset *kubernetes.Clientset, org string, namespaces []*v1.Namespace, secrets map[string]*v1.Secret, password string, rotatedAt string) {
+	for _, ns := range namespaces {
+		if secret, ok := secrets[ns.Name]; ok && secret.Annotations[rotatedAtAnnotation] == rotatedAt {
+			continue
+		}
+		err := storeViewerPassword(clientset, ns.Name, org, password, rotatedAt)
+		if err != nil {
+			glog.Errorln("fail to store viewer password of " + org + " in namespace " + ns.Name + ": " + err.Error())
+			continue
+		}
+		glog.Infoln("viewer password of " + org + " stored in namespace " + ns.Name)
+	}
+}
+
+// storeViewerPassword creates or updates the viewer secret of a namespace
+func storeViewerPassword(clientset *kubernetes.Clientset, namespace string, viewer string, password string, rotatedAt string) error {
+	secrets := clientset.CoreV1().Secrets(namespace)
+	data := map[string][]byte{"username": []byte(viewer), "password": []byte(password)}
+	secret, err := secrets.Get(viewerSecretName(), metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		_, err = secrets.Create(&v1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: viewerSecretName(), Annotations: map[string]string{rotatedAtAnnotation: rotatedAt}},
+			Data:       data,
+		})
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	secret.Data = data
+	if secret.Annotations == nil {
+		secret.Annotations = make(map[string]string)
+	}
+	secret.Annotations[rotatedAtAnnotation] = rotatedAt
+	_, err = secrets.Update(secret)
+	return err
+}
+
+// viewerSecretName reads VIEWER_SECRET, the name of the secret holding the viewer password in each tenant namespace. The default is "grafana-viewer".
+func viewerSecretName() string {
+	name := os.Getenv("VIEWER_SECRET")
+	if name == "" {
+		return "grafana-viewer"
+	}
+	return name
+}
+
+// passwordRotationInterval reads PASSWORD_ROTATION_INTERVAL, e.g. "720h". Passwords are only rotated by annotation if it is not set.
+func passwordRotationInterval() time.Duration {
+	interval, err := time.ParseDuration(os.Getenv("PASSWORD_ROTATION_INTERVAL"))
+	if err != nil || interval < 0 {
+		return 0
+	}
+	return interval
+}
@@ -0,0 +1,20 @@
+package controller
+
+import (
+	"k8s-grafana-controller/grafana"
+)
+
+// reportQuotas exposes the limit and usage of the quotas of a tenant org as the grafana_controller_org_quota_limit and
+// grafana_controller_org_quota_used metrics
+func reportQuotas(grafanaClient *grafana.GrafanaClient, org string) {
+	for target, quota := range grafanaClient.GetTenantQuotas(org) {
+		setGauge("grafana_controller_org_quota_limit", "Limit of a quota of a tenant org, -1 is unlimited.", float64(quota.Limit), "org", org, "target", target)
+		setGauge("grafana_controller_org_quota_used", "Usage of a quota of a tenant org.", float64(quota.Used), "org", org, "target", target)
+	}
+}
+
+// deleteQuotaGauges removes the quota metrics of a deleted tenant org
+func deleteQuotaGauges(org string) {
+	deleteGauges("grafana_controller_org_quota_limit", "org", org)
+	deleteGauges("grafana_controller_org_quota_used", "org", org)
+}
@@ -0,0 +1,338 @@
+package controller
+
+import (
+	"encoding/json"
+	"k8s-grafana-controller/grafana"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+)
+
+// rbacUsersAnnotation of a namespace lists the users given access to its organization from role bindings, so they can be removed later
+const rbacUsersAnnotation = "grafana-controller/rbac-users"
+
+// rbacTeamsAnnotation of a namespace lists the teams made for groups bound in it, so they can be removed later
+const rbacTeamsAnnotation = "grafana-controller/rbac-teams"
+
+// rbacTeamViewersAnnotation of a namespace lists the team members added to its organization as Viewers for their teams,
+// so they can be removed when they are no longer in any team
+const rbacTeamViewersAnnotation = "grafana-controller/rbac-team-viewers"
+
+// WatchRoleBindings watches RoleBindings and ClusterRoleBindings, and gives their User subjects a role in the organizations of
+// the namespaces they are bound in. ClusterRoleBindings grant the role in every tenant organization. Existing bindings
+// were synced with their tenants, so only changes after they are listed are watched.
+func WatchRoleBindings(clientset *kubernetes.Clientset, grafanaClient *grafana.GrafanaClient) {
+	go watchClusterRoleBindings(clientset, grafanaClient)
+	roleBindings, err := clientset.RbacV1().RoleBindings("").List(metav1.ListOptions{})
+	if err != nil {
+		glog.Fatal(err)
+	}
+	watchrb, err := clientset.RbacV1().RoleBindings("").Watch(metav1.ListOptions{Watch: true, ResourceVersion: roleBindings.ResourceVersion})
+	if err != nil {
+		glog.Fatal(err)
+	} else {
+		eventChan := watchrb.ResultChan()
+		for event := range eventChan {
+			rb, ok := event.Object.(*rbacv1.RoleBinding)
+			if !ok {
+				glog.Errorln("unexpected type when watching rolebindings")
+			} else {
+				syncNamespaceRoles(clientset, grafanaClient, rb.Namespace)
+				requestAuthMapping()
+			}
+		}
+	}
+	glog.Flush()
+}
+
+// watchClusterRoleBindings syncs the org roles of every namespace when a ClusterRoleBinding changes
+func watchClusterRoleBindings(clientset *kubernetes.Clientset, grafanaClient *grafana.GrafanaClient) {
+	clusterRoleBindings, err := clientset.RbacV1().ClusterRoleBindings().List(metav1.ListOptions{})
+	if err != nil {
+		glog.Fatal(err)
+	}
+	watchcrb, err := clientset.RbacV1().ClusterRoleBindings().Watch(metav1.ListOptions{Watch: true, ResourceVersion: clusterRoleBindings.ResourceVersion})
+	if err != nil {
+		glog.Fatal(err)
+	} else {
+		eventChan := watchcrb.ResultChan()
+		for event := range eventChan {
+			_, ok := event.Object.(*rbacv1.ClusterRoleBinding)
+			if !ok {
+				glog.Errorln("unexpected type when watching clusterrolebindings")
+				continue
+			}
+			// a burst of changes, e.g. from applying a chart, is synced once
+			drainEvents(eventChan, time.Second)
+			syncAllNamespaceRoles(clientset, grafanaClient)
+			requestAuthMapping()
+		}
+	}
+	glog.Flush()
+}
+
+// drainEvents discards the events of a watch until none arrives for the quiet period
+func drainEvents(eventChan <-chan watch.Event, quiet time.Duration) {
+	for {
+		select {
+		case _, ok := <-eventChan:
+			if !ok {
+				return
+			}
+		case <-time.After(quiet):
+			return
+		}
+	}
+}
+
+// syncAllNamespaceRoles syncs the org roles of every tenant
+func syncAllNamespaceRoles(clientset *kubernetes.Clientset, grafanaClient *grafana.GrafanaClient) {
+	tenants, err := listTenants(clientset)
+	if err != nil {
+		glog.Error(err)
+		return
+	}
+	for _, tenant := range tenants {
+		syncTenantRoles(clientset, grafanaClient, tenant)
+	}
+}
+
+// syncNamespaceRoles syncs the org roles of the tenant of a namespace
+func syncNamespaceRoles(clientset *kubernetes.Clientset, grafanaClient *grafana.GrafanaClient, namespace string) {
+	ns, err := clientset.CoreV1().Namespaces().Get(namespace, metav1.GetOptions{})
+	if err != nil {
+		glog.Error(err)
+		return
+	}
+	if tenant, ok := tenantOf(clientset, ns); ok {
+		syncTenantRoles(clientset, grafanaClient, tenant)
+	}
+}
+
+// syncTenantRoles gives the users bound in the namespaces of a tenant and the global administrators their org role, and
+// makes teams of the groups bound in them and of the admin teams, and removes the users and teams whose bindings are gone.
+// The users and teams given access are kept in annotations of every namespace of the tenant, so they are not lost when
+// namespaces join or leave it.
+func syncTenantRoles(clientset *kubernetes.Clientset, grafanaClient *grafana.GrafanaClient, tenant grafana.Tenant) {
+	members, err := memberNamespaces(clientset, tenantMembers(clientset, tenant))
+	if err != nil {
+		glog.Error(err)
+		return
+	}
+	var names []string
+	for _, ns := range members {
+		names = append(names, ns.Name)
+	}
+	users, groups, err := boundOrgRoles(clientset, names)
+	if err != nil {
+		glog.Error(err)
+		return
+	}
+	addOwners(tenant.Name, users, groups)
+	// teams are kept as they are if their members can not be read, but users are still synced
+	teams, err := groupTeams(clientset, groups)
+	syncTeams := err == nil
+	if err != nil {
+		glog.Warningln("fail to read team members, skip syncing teams of org " + tenant.Name + ": " + err.Error())
+		teams = make(map[string]grafana.Team)
+	}
+	err = addAdmins(clientset, grafanaClient, users, teams)
+	if err != nil {
+		glog.Errorln("skip syncing roles of org " + tenant.Name + ": " + err.Error())
+		return
+	}
+	previous, synced := syncedNames(members, rbacUsersAnnotation)
+	if !synced && adminName() != "" {
+		// orgs created before their users were synced had ADMIN_NAME added, without listing it
+		previous = []string{adminName()}
+	}
+	grafanaClient.SyncOrgUsers(tenant.Name, users, previous)
+	for _, ns := range members {
+		setAnnotationList(clientset, ns.Name, rbacUsersAnnotation, users, annotationList(ns.Annotations, rbacUsersAnnotation))
+	}
+	if !syncTeams {
+		return
+	}
+	previous, _ = syncedNames(members, rbacTeamsAnnotation)
+	// users bound by role get their org role from their bindings, so they are not team viewers
+	var previousViewers []string
+	logins, _ := syncedNames(members, rbacTeamViewersAnnotation)
+	for _, login := range logins {
+		if _, ok := users[login]; !ok {
+			previousViewers = append(previousViewers, login)
+		}
+	}
+	viewers := grafanaClient.SyncTeams(tenant, teams, previous, previousViewers)
+	for _, ns := range members {
+		setAnnotationList(clientset, ns.Name, rbacTeamsAnnotation, teams, annotationList(ns.Annotations, rbacTeamsAnnotation))
+		setAnnotationList(clientset, ns.Name, rbacTeamViewersAnnotation, viewers, annotationList(ns.Annotations, rbacTeamViewersAnnotation))
+	}
+}
+
+// memberNamespaces gets the namespaces of a tenant by name, skipping the ones that are gone
+func memberNamespaces(clientset *kubernetes.Clientset, names []string) ([]v1.Namespace, error) {
+	var namespaces []v1.Namespace
+	for _, name := range names {
+		ns, err := clientset.CoreV1().Namespaces().Get(name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		namespaces = append(namespaces, *ns)
+	}
+	return namespaces, nil
+}
+
+// syncedNames gives the union of the names listed in an annotation of namespaces, and whether any namespace has it
+func syncedNames(namespaces []v1.Namespace, annotation string) ([]string, bool) {
+	seen := make(map[string]bool)
+	var names []string
+	synced := false
+	for _, ns := range namespaces {
+		if _, ok := ns.Annotations[annotation]; ok {
+			synced = true
+		}
+		for _, name := range annotationList(ns.Annotations, annotation) {
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	return names, synced
+}
+
+// boundOrgRoles gives the org role of every User and Group subject bound in namespaces by a RoleBinding or a ClusterRoleBinding
+func boundOrgRoles(clientset *kubernetes.Clientset, namespaces []string) (map[string]string, map[string]string, error) {
+	mapping := roleMapping()
+	users := make(map[string]string)
+	groups := make(map[string]string)
+	add := func(roleRef rbacv1.RoleRef, subjects []rbacv1.Subject) {
+		role, ok := mapping[roleMappingKey(roleRef)]
+		if !ok {
+			return
+		}
+		for _, subject := range subjects {
+			if strings.HasPrefix(subject.Name, "system:") {
+				continue
+			}
+			switch subject.Kind {
+			case rbacv1.UserKind:
+				users[subject.Name] = grafana.HigherRole(users[subject.Name], role)
+			case rbacv1.GroupKind:
+				groups[subject.Name] = grafana.HigherRole(groups[subject.Name], role)
+			}
+		}
+	}
+	for _, namespace := range namespaces {
+		roleBindings, err := clientset.RbacV1().RoleBindings(namespace).List(metav1.ListOptions{})
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, rb := range roleBindings.Items {
+			add(rb.RoleRef, rb.Subjects)
+		}
+	}
+	clusterRoleBindings, err := clientset.RbacV1().ClusterRoleBindings().List(metav1.ListOptions{})
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, crb := range clusterRoleBindings.Items {
+		add(crb.RoleRef, crb.Subjects)
+	}
+	return users, groups, nil
+}
+
+// annotationList reads an annotation holding a json list of names
+func annotationList(annotations map[string]string, annotation string) []string {
+	var list []string
+	if value := annotations[annotation]; value != "" {
+		_ = json.Unmarshal([]byte(value), &list)
+	}
+	return list
+}
+
+// setAnnotationList sets an annotation of a namespace to the sorted keys of m, unless they are the names in previous
+func setAnnotationList(clientset *kubernetes.Clientset, namespace string, annotation string, m interface{}, previous []string) {
+	var list []string
+	for _, key := range reflect.ValueOf(m).MapKeys() {
+		list = append(list, key.String())
+	}
+	sort.Strings(list)
+	sort.Strings(previous)
+	if strings.Join(list, ",") == strings.Join(previous, ",") {
+		return
+	}
+	setNamespaceAnnotation(clientset, namespace, annotation, list)
+}
+
+// setNamespaceAnnotation sets an annotation of a namespace to the json of value
+func setNamespaceAnnotation(clientset *kubernetes.Clientset, namespace string, annotation string, value interface{}) {
+	content, _ := json.Marshal(value)
+	patch, _ := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]string{annotation: string(content)},
+		},
+	})
+	_, err := clientset.CoreV1().Namespaces().Patch(namespace, types.MergePatchType, patch)
+	if err != nil {
+		glog.Error(err)
+	}
+}
+
+// removeNamespaceAnnotation removes annotations of a namespace
+func removeNamespaceAnnotation(clientset *kubernetes.Clientset, namespace string, annotations ...string) {
+	removed := make(map[string]interface{})
+	for _, annotation := range annotations {
+		removed[annotation] = nil
+	}
+	patch, _ := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": removed,
+		},
+	})
+	_, err := clientset.CoreV1().Namespaces().Patch(namespace, types.MergePatchType, patch)
+	if err != nil {
+		glog.Error(err)
+	}
+}
+
+// roleMapping reads ROLE_MAPPING, json mapping kubernetes role names to grafana org roles, which replaces the default
+// mapping of the view, edit and admin cluster roles to Viewer, Editor and Admin. Names are the ones of ClusterRoles, or
+// "Role/<name>" for namespaced Roles. The default is used if ROLE_MAPPING is invalid.
+func roleMapping() map[string]string {
+	defaults := map[string]string{"view": "Viewer", "edit": "Editor", "admin": "Admin"}
+	value := os.Getenv("ROLE_MAPPING")
+	if value == "" {
+		return defaults
+	}
+	var mapping map[string]string
+	err := json.Unmarshal([]byte(value), &mapping)
+	if err != nil {
+		glog.Errorln("invalid ROLE_MAPPING: " + err.Error())
+		return defaults
+	}
+	return mapping
+}
+
+// roleMappingKey gives the name of the role a binding refers to in ROLE_MAPPING, so a namespaced Role is not mistaken
+// for the ClusterRole of the same name
+func roleMappingKey(roleRef rbacv1.RoleRef) string {
+	if roleRef.Kind == "ClusterRole" {
+		return roleRef.Name
+	}
+	return roleRef.Kind + "/" + roleRef.Name
+}
@@ -0,0 +1,31 @@
+package controller
+
+import (
+	"os"
+	"testing"
+
+	rbacv1 "k8s.io/api/rbac/v1"
+)
+
+func TestRoleMapping(t *testing.T) {
+	defer os.Unsetenv("ROLE_MAPPING")
+	tests := []struct {
+		name    string
+		mapping string
+		roleRef rbacv1.RoleRef
+		want    string
+	}{
+		{"default cluster role", "", rbacv1.RoleRef{Kind: "ClusterRole", Name: "edit"}, "Editor"},
+		{"namespaced role named like a default", "", rbacv1.RoleRef{Kind: "Role", Name: "view"}, ""},
+		{"replaced defaults", `{"cluster-admin": "Admin"}`, rbacv1.RoleRef{Kind: "ClusterRole", Name: "view"}, ""},
+		{"mapped cluster role", `{"cluster-admin": "Admin"}`, rbacv1.RoleRef{Kind: "ClusterRole", Name: "cluster-admin"}, "Admin"},
+		{"mapped namespaced role", `{"Role/editor": "Editor"}`, rbacv1.RoleRef{Kind: "Role", Name: "editor"}, "Editor"},
+		{"invalid mapping", `{"view": 1}`, rbacv1.RoleRef{Kind: "ClusterRole", Name: "view"}, "Viewer"},
+	}
+	for _, test := range tests {
+		os.Setenv("ROLE_MAPPING", test.mapping)
+		if got := roleMapping()[roleMappingKey(test.roleRef)]; got != test.want {
+			t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+		}
+	}
+}
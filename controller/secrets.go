@@ -0,0 +1,108 @@
+package controller
+
+import (
+	"errors"
+	"k8s-grafana-controller/grafana"
+	"strings"
+
+	"github.com/golang/glog"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+)
+
+// secretReader reads data source credentials from kubernetes secrets
+func secretReader(clientset *kubernetes.Clientset) func(namespace string, name string, key string) (string, error) {
+	return func(namespace string, name string, key string) (string, error) {
+		secret, err := clientset.CoreV1().Secrets(namespace).Get(name, metav1.GetOptions{})
+		if err != nil {
+			return "", err
+		}
+		value, ok := secret.Data[key]
+		if !ok {
+			return "", errors.New("secret " + namespace + "/" + name + " has no key " + key)
+		}
+		return string(value), nil
+	}
+}
+
+// WatchDataSourceSecrets watches the secrets data sources read credentials from, and updates the data sources of the tenants
+// reading a secret when it changes.
+func WatchDataSourceSecrets(clientset *kubernetes.Clientset, grafanaClient *grafana.GrafanaClient) {
+	watched := make(map[string]bool)
+	for _, ref := range grafana.DataSourceSecrets() {
+		namespace, name := ref.Namespace, ref.Name
+		// templated namespaces and names depend on the tenant, so all of them are watched
+		if strings.Contains(namespace, "{%") {
+			namespace = ""
+		}
+		if strings.Contains(name, "{%") {
+			name = ""
+		}
+		if watched[namespace+"/"+name] {
+			continue
+		}
+		watched[namespace+"/"+name] = true
+		go watchSecret(clientset, grafanaClient, namespace, name)
+	}
+}
+
+// watchSecret watches a secret, or all secrets in a namespace if name is empty, or in all namespaces if namespace is empty too
+func watchSecret(clientset *kubernetes.Clientset, grafanaClient *grafana.GrafanaClient, namespace string, name string) {
+	options := metav1.ListOptions{Watch: true}
+	if name != "" {
+		options.FieldSelector = "metadata.name=" + name
+	}
+	watchSecrets, err := clientset.CoreV1().Secrets(namespace).Watch(options)
+	if err != nil {
+		glog.Fatal(err)
+	} else {
+		eventChan := watchSecrets.ResultChan()
+		for event := range eventChan {
+			secret, ok := event.Object.(*v1.Secret)
+			if !ok {
+				glog.Errorln("unexpected type when watching secrets")
+				continue
+			}
+			// existing secrets are listed as added when the watch starts, and were used when tenants were posted
+			if event.Type != watch.Modified && event.Type != watch.Deleted {
+				continue
+			}
+			resyncSecretDataSources(clientset, grafanaClient, secret)
+		}
+	}
+	glog.Flush()
+}
+
+// resyncSecretDataSources updates the data sources of the tenants that read credentials from a secret
+func resyncSecretDataSources(clientset *kubernetes.Clientset, grafanaClient *grafana.GrafanaClient, secret *v1.Secret) {
+	tenants, err := listTenants(clientset)
+	if err != nil {
+		glog.Error(err)
+		return
+	}
+	for _, tenant := range tenants {
+		for _, ref := range grafana.TenantDataSourceSecrets(tenant) {
+			if ref.Namespace == secret.Namespace && ref.Name == secret.Name {
+				glog.Infoln("secret " + secret.Namespace + "/" + secret.Name + " changed, updating data sources of org " + tenant.Name)
+				grafanaClient.PostTenantDataSources(tenant)
+				break
+			}
+		}
+	}
+	glog.Flush()
+}
+
+// resyncDataSources adds and updates the data sources of every tenant
+func resyncDataSources(clientset *kubernetes.Clientset, grafanaClient *grafana.GrafanaClient) {
+	tenants, err := listTenants(clientset)
+	if err != nil {
+		glog.Error(err)
+		return
+	}
+	for _, tenant := range tenants {
+		grafanaClient.PostTenantDataSources(tenant)
+	}
+	glog.Flush()
+}
@@ -0,0 +1,170 @@
+package controller
+
+import (
+	"errors"
+	"k8s-grafana-controller/grafana"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/golang/glog"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+)
+
+// serviceRef points to a kubernetes Service by name or by label selector
+type serviceRef struct {
+	namespace string
+	name      string
+	selector  string
+	// port is the name or number of the service port. The first port is used if it is empty.
+	port string
+}
+
+// serviceRefFromEnv reads <prefix>_SERVICE, "name" or "namespace/name", or <prefix>_SERVICE_SELECTOR, a label selector,
+// with <prefix>_SERVICE_NAMESPACE (defaults to "monitoring") and <prefix>_SERVICE_PORT. It returns nil if neither is set,
+// or if <prefix>_IP sets the address explicitly.
+func serviceRefFromEnv(prefix string) *serviceRef {
+	if os.Getenv(prefix+"_IP") != "" {
+		if os.Getenv(prefix+"_SERVICE") != "" || os.Getenv(prefix+"_SERVICE_SELECTOR") != "" {
+			glog.Warningln(prefix + "_IP is set, so the " + strings.ToLower(prefix) + " service is not used")
+		}
+		return nil
+	}
+	ref := &serviceRef{
+		namespace: os.Getenv(prefix + "_SERVICE_NAMESPACE"),
+		name:      os.Getenv(prefix + "_SERVICE"),
+		selector:  os.Getenv(prefix + "_SERVICE_SELECTOR"),
+		port:      os.Getenv(prefix + "_SERVICE_PORT"),
+	}
+	if ref.name == "" && ref.selector == "" {
+		return nil
+	}
+	if parts := strings.SplitN(ref.name, "/", 2); len(parts) == 2 {
+		ref.namespace, ref.name = parts[0], parts[1]
+	}
+	if ref.namespace == "" {
+		ref.namespace = "monitoring"
+	}
+	return ref
+}
+
+// matches tells if a service is the one the reference points to
+func (ref *serviceRef) matches(svc *v1.Service) bool {
+	if svc.Namespace != ref.namespace {
+		return false
+	}
+	if ref.name != "" {
+		return svc.Name == ref.name
+	}
+	selector, err := labels.Parse(ref.selector)
+	if err != nil {
+		glog.Error(err)
+		return false
+	}
+	return selector.Matches(labels.Set(svc.Labels))
+}
+
+// resolve finds the service and gives its host:port
+func (ref *serviceRef) resolve(clientset *kubernetes.Clientset) (string, error) {
+	if ref.name != "" {
+		svc, err := clientset.CoreV1().Services(ref.namespace).Get(ref.name, metav1.GetOptions{})
+		if err != nil {
+			return "", err
+		}
+		return ref.address(svc)
+	}
+	services, err := clientset.CoreV1().Services(ref.namespace).List(metav1.ListOptions{LabelSelector: ref.selector})
+	if err != nil {
+		return "", err
+	}
+	if len(services.Items) == 0 {
+		return "", errors.New("no service matches " + ref.namespace + "/" + ref.selector)
+	}
+	return ref.address(&services.Items[0])
+}
+
+// address gives host:port of a service. Headless services are addressed by their DNS name.
+func (ref *serviceRef) address(svc *v1.Service) (string, error) {
+	host := svc.Spec.ClusterIP
+	if host == "" || host == v1.ClusterIPNone {
+		host = svc.Name + "." + svc.Namespace + ".svc"
+	}
+	for _, port := range svc.Spec.Ports {
+		if ref.port == "" || ref.port == port.Name || ref.port == strconv.Itoa(int(port.Port)) {
+			return host + ":" + strconv.Itoa(int(port.Port)), nil
+		}
+	}
+	return "", errors.New("service " + svc.Namespace + "/" + svc.Name + " has no port " + ref.port)
+}
+
+// WatchServices watches the grafana and prometheus services set by GRAFANA_SERVICE and PROMETHEUS_SERVICE, or their selectors.
+// When a service changes, the clients talk to the new grafana address, and tenant data sources are updated to the new prometheus address.
+func WatchServices(clientset *kubernetes.Clientset, grafanaClient *grafana.GrafanaClient, controllerClient *grafana.GrafanaClient) {
+	if ref := serviceRefFromEnv("GRAFANA"); ref != nil {
+		go watchService(clientset, ref, func(address string) {
+			grafanaClient.SetGrafanaIP(address)
+			controllerClient.SetGrafanaIP(address)
+			glog.Infoln("grafana address changed to " + address)
+		})
+	}
+	if ref := serviceRefFromEnv("PROMETHEUS"); ref != nil {
+		go watchService(clientset, ref, func(address string) {
+			grafana.SetPrometheusAddress(address)
+			glog.Infoln("prometheus address changed to " + address)
+			resyncDataSources(clientset, controllerClient)
+		})
+	}
+}
+
+// watchService calls onChange with the new address whenever the address of the referenced service changes
+func watchService(clientset *kubernetes.Clientset, ref *serviceRef, onChange func(address string)) {
+	current, err := ref.resolve(clientset)
+	if err != nil {
+		glog.Warningln(err)
+	}
+	watchsvc, err := clientset.CoreV1().Services(ref.namespace).Watch(metav1.ListOptions{Watch: true, LabelSelector: ref.selector})
+	if err != nil {
+		glog.Fatal(err)
+	} else {
+		eventChan := watchsvc.ResultChan()
+		for event := range eventChan {
+			svc, ok := event.Object.(*v1.Service)
+			if !ok {
+				glog.Errorln("unexpected type when watching services")
+				continue
+			}
+			if !ref.matches(svc) || (event.Type != watch.Added && event.Type != watch.Modified) {
+				continue
+			}
+			address, err := ref.address(svc)
+			if err != nil {
+				glog.Warningln(err)
+				continue
+			}
+			if address != current {
+				current = address
+				onChange(address)
+			}
+		}
+	}
+	glog.Flush()
+}
+
+// resolveServices resolves the grafana and prometheus services at start. The grafana address is empty if GRAFANA_SERVICE is not set.
+func resolveServices(clientset *kubernetes.Clientset) (string, error) {
+	if ref := serviceRefFromEnv("PROMETHEUS"); ref != nil {
+		address, err := ref.resolve(clientset)
+		if err != nil {
+			return "", err
+		}
+		grafana.SetPrometheusAddress(address)
+	}
+	if ref := serviceRefFromEnv("GRAFANA"); ref != nil {
+		return ref.resolve(clientset)
+	}
+	return "", nil
+}
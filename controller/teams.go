@@ -0,0 +1,96 @@
+package controller
+
+import (
+	"k8s-grafana-controller/grafana"
+	"os"
+	"strings"
+
+	"github.com/golang/glog"
+	"k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+)
+
+// teamPermissions gives the folder permission of a team from the org role of its group
+var teamPermissions = map[string]string{"Viewer": "View", "Editor": "Edit", "Admin": "Admin"}
+
+// groupTeams makes a team of each group with its org role. Members are read from TEAM_MEMBERS_CONFIGMAP, or left to the
+// team sync of external authentication if TEAM_SYNC is "external". Teams have no members if the ConfigMap does not exist.
+func groupTeams(clientset *kubernetes.Clientset, groups map[string]string) (map[string]grafana.Team, error) {
+	var members map[string][]string
+	if namespace, name := teamMembersConfigMap(); name != "" {
+		members = make(map[string][]string)
+		cm, err := clientset.CoreV1().ConfigMaps(namespace).Get(name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			glog.Warningln("team members configmap " + namespace + "/" + name + " not found, teams have no members")
+			cm = &v1.ConfigMap{}
+		} else if err != nil {
+			return nil, err
+		}
+		for group, value := range cm.Data {
+			for _, login := range strings.Fields(value) {
+				members[group] = append(members[group], login)
+			}
+		}
+	}
+	teams := make(map[string]grafana.Team)
+	for group, role := range groups {
+		team := grafana.Team{Permission: teamPermissions[role]}
+		if members != nil {
+			team.Members = append([]string{}, members[group]...)
+		} else if teamSync() == "external" {
+			team.ExternalGroup = group
+		}
+		teams[group] = team
+	}
+	return teams, nil
+}
+
+// WatchTeamMembers watches TEAM_MEMBERS_CONFIGMAP, and syncs the teams of every tenant when it changes
+func WatchTeamMembers(clientset *kubernetes.Clientset, grafanaClient *grafana.GrafanaClient) {
+	namespace, name := teamMembersConfigMap()
+	if name == "" {
+		return
+	}
+	watchcm, err := clientset.CoreV1().ConfigMaps(namespace).Watch(metav1.ListOptions{Watch: true, FieldSelector: "metadata.name=" + name})
+	if err != nil {
+		glog.Fatal(err)
+	} else {
+		eventChan := watchcm.ResultChan()
+		for event := range eventChan {
+			_, ok := event.Object.(*v1.ConfigMap)
+			if !ok {
+				glog.Errorln("unexpected type when watching configmaps")
+				continue
+			}
+			// the configmap is read when tenants are synced, so only changes matter
+			if event.Type != watch.Modified && event.Type != watch.Deleted {
+				continue
+			}
+			glog.Infoln("team members changed, syncing teams")
+			syncAllNamespaceRoles(clientset, grafanaClient)
+		}
+	}
+	glog.Flush()
+}
+
+// teamMembersConfigMap reads TEAM_MEMBERS_CONFIGMAP, "namespace/name" of a ConfigMap whose keys are group names and whose
+// values are the logins of the members, separated by spaces or new lines. The namespace defaults to "monitoring".
+func teamMembersConfigMap() (string, string) {
+	value := os.Getenv("TEAM_MEMBERS_CONFIGMAP")
+	if value == "" {
+		return "", ""
+	}
+	if i := strings.Index(value, "/"); i >= 0 {
+		return value[:i], value[i+1:]
+	}
+	return "monitoring", value
+}
+
+// teamSync reads TEAM_SYNC. If it is "external", groups are linked to their teams for the team sync of grafana enterprise.
+func teamSync() string {
+	sync := os.Getenv("TEAM_SYNC")
+	return sync
+}
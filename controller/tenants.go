@@ -0,0 +1,231 @@
+package controller
+
+import (
+	"k8s-grafana-controller/grafana"
+	"os"
+	"sort"
+
+	"github.com/golang/glog"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// orgName gives the organization of a namespace: the value of its TENANT_GROUP_LABEL, or else its name. With Capsule, it
+// is empty for namespaces outside of Capsule tenants, which have no organization.
+func orgName(ns *v1.Namespace) string {
+	if label := tenantGroupLabel(); label != "" {
+		if value := ns.Labels[label]; value != "" {
+			return value
+		}
+	}
+	if capsuleEnabled() {
+		return ""
+	}
+	return ns.Name
+}
+
+// orgOf gives the organization of a namespace by name, as memberOrg does
+func orgOf(clientset *kubernetes.Clientset, namespace string) string {
+	if tenantGroupLabel() == "" {
+		return namespace
+	}
+	ns, err := clientset.CoreV1().Namespaces().Get(namespace, metav1.GetOptions{})
+	if err != nil {
+		glog.Error(err)
+		return namespace
+	}
+	return memberOrg(clientset, ns)
+}
+
+// membership is the organization of a namespace, and whether the namespace is in it by TENANT_GROUP_LABEL
+type membership struct {
+	org     string
+	grouped bool
+}
+
+// membershipOf gives the membership of a namespace
+func membershipOf(ns *v1.Namespace) membership {
+	return membership{org: orgName(ns), grouped: groupLabelValue(ns) != ""}
+}
+
+// groupLabelValue gives the value of TENANT_GROUP_LABEL on a namespace, or "" if the namespace is not grouped by label
+func groupLabelValue(ns *v1.Namespace) string {
+	if label := tenantGroupLabel(); label != "" {
+		return ns.Labels[label]
+	}
+	return ""
+}
+
+// tenantOf gives the tenant of a namespace, and false if the namespace belongs to no tenant. Namespaces grouped by label
+// share a tenant, whose labels and annotations are the ones of its first namespace by name.
+func tenantOf(clientset *kubernetes.Clientset, ns *v1.Namespace) (grafana.Tenant, bool) {
+	org := orgName(ns)
+	if org == "" {
+		return grafana.Tenant{}, false
+	}
+	members := []v1.Namespace{*ns}
+	if label := tenantGroupLabel(); label != "" {
+		namespaces, err := clientset.CoreV1().Namespaces().List(metav1.ListOptions{LabelSelector: label + "=" + org})
+		if err != nil {
+			glog.Error(err)
+			return grafana.Tenant{}, false
+		}
+		for _, member := range namespaces.Items {
+			if member.Name != ns.Name {
+				members = append(members, member)
+			}
+		}
+	}
+	for _, tenant := range groupTenants(members) {
+		if tenant.Name == org && containsString(tenant.Namespaces, ns.Name) {
+			return tenant, true
+		}
+	}
+	return grafana.Tenant{}, false
+}
+
+// memberOrg gives the org of a namespace like orgName, but none for a namespace without TENANT_GROUP_LABEL that is
+// named like the org of a group, as groupTenants does
+func memberOrg(clientset *kubernetes.Clientset, ns *v1.Namespace) string {
+	org := orgName(ns)
+	label := tenantGroupLabel()
+	if org == "" || label == "" || groupLabelValue(ns) != "" {
+		return org
+	}
+	namespaces, err := clientset.CoreV1().Namespaces().List(metav1.ListOptions{LabelSelector: label + "=" + org})
+	if err != nil {
+		glog.Error(err)
+		return ""
+	}
+	if len(namespaces.Items) > 0 {
+		return ""
+	}
+	return org
+}
+
+// listTenants gives the tenants of all namespaces
+func listTenants(clientset *kubernetes.Clientset) ([]grafana.Tenant, error) {
+	namespaces, err := clientset.CoreV1().Namespaces().List(metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return groupTenants(namespaces.Items), nil
+}
+
+// groupTenants groups namespaces into tenants by organization, and adds the HNC descendants of their namespaces. Only
+// namespaces labeled with TENANT_GROUP_LABEL are grouped. A namespace without the label that is named like the org of
+// a group gets no org, so it never shares the org of the group.
+func groupTenants(namespaces []v1.Namespace) []grafana.Tenant {
+	sort.Slice(namespaces, func(i, j int) bool { return namespaces[i].Name < namespaces[j].Name })
+	type orgKey struct {
+		name    string
+		grouped bool
+	}
+	var keys []orgKey
+	var tenants []grafana.Tenant
+	index := make(map[orgKey]int)
+	for _, ns := range namespaces {
+		org := orgName(&ns)
+		if org == "" {
+			continue
+		}
+		key := orgKey{name: org, grouped: groupLabelValue(&ns) != ""}
+		if i, ok := index[key]; ok {
+			tenants[i].Namespaces = append(tenants[i].Namespaces, ns.Name)
+			continue
+		}
+		index[key] = len(tenants)
+		keys = append(keys, key)
+		tenants = append(tenants, grafana.Tenant{Name: org, Namespaces: []string{ns.Name}, Labels: ns.Labels, Annotations: ns.Annotations})
+	}
+	var result []grafana.Tenant
+	for i, key := range keys {
+		if _, ok := index[orgKey{name: key.name, grouped: true}]; ok && !key.grouped {
+			glog.Warningln("namespace " + key.name + " gets no org, since namespaces labeled " + tenantGroupLabel() + "=" + key.name + " have it")
+			continue
+		}
+		result = append(result, tenants[i])
+	}
+	if hncEnabled() {
+		addDescendants(result, namespaces)
+	}
+	return result
+}
+
+// memberNamespacesOf picks the namespaces of a tenant out of a list, without the HNC descendants it only shows
+func memberNamespacesOf(tenant grafana.Tenant, namespaces []v1.Namespace) []*v1.Namespace {
+	var members []*v1.Namespace
+	for i := range namespaces {
+		if orgName(&namespaces[i]) == tenant.Name && containsString(tenant.Namespaces, namespaces[i].Name) {
+			members = append(members, &namespaces[i])
+		}
+	}
+	return members
+}
+
+// tenantMembers gives the namespaces that belong to a tenant, without the HNC descendants it only shows
+func tenantMembers(clientset *kubernetes.Clientset, tenant grafana.Tenant) []string {
+	if !hncEnabled() {
+		return tenant.NamespaceList()
+	}
+	var members []string
+	for _, namespace := range tenant.NamespaceList() {
+		if orgOf(clientset, namespace) == tenant.Name {
+			members = append(members, namespace)
+		}
+	}
+	return members
+}
+
+// leaveTenant updates the organization a namespace left and removes the dashboards of its ConfigMaps, or deletes the
+// organization if the namespace was its last one. The users and teams of the old organization are cleared from a
+// namespace that still exists.
+func leaveTenant(clientset *kubernetes.Clientset, grafanaClient *grafana.GrafanaClient, namespace string, org string, dbList []grafana.Dashboard) {
+	if ns, err := clientset.CoreV1().Namespaces().Get(namespace, metav1.GetOptions{}); err == nil && ns.DeletionTimestamp == nil {
+		removeNamespaceAnnotation(clientset, namespace, rbacUsersAnnotation, rbacTeamsAnnotation, rbacTeamViewersAnnotation)
+	}
+	if label := tenantGroupLabel(); label != "" {
+		namespaces, err := clientset.CoreV1().Namespaces().List(metav1.ListOptions{LabelSelector: label + "=" + org})
+		if err != nil {
+			glog.Error(err)
+			return
+		}
+		var members []v1.Namespace
+		for _, ns := range namespaces.Items {
+			if ns.Name != namespace && ns.DeletionTimestamp == nil {
+				members = append(members, ns)
+			}
+		}
+		if len(members) > 0 {
+			tenant := groupTenants(members)[0]
+			grafanaClient.DeleteNamespaceConfigMapDashboards(org, namespace)
+			grafanaClient.PostTenantDashboards(tenant, dbList)
+			syncTenantRoles(clientset, grafanaClient, tenant)
+			return
+		}
+	}
+	deleteTenant(clientset, grafanaClient, org)
+}
+
+// evictUngrouped makes the namespace named like the org of a grouped tenant leave the org if it is not grouped itself,
+// so the org a group takes over is not shared with the namespace it belonged to
+func evictUngrouped(clientset *kubernetes.Clientset, grafanaClient *grafana.GrafanaClient, orgs map[string]membership, tenant grafana.Tenant, dbList []grafana.Dashboard) {
+	if orgs[tenant.Name] != (membership{org: tenant.Name}) || containsString(tenant.Namespaces, tenant.Name) {
+		return
+	}
+	delete(orgs, tenant.Name)
+	revokeAPIToken(clientset, grafanaClient, tenant.Name, tenant.Name)
+	leaveTenant(clientset, grafanaClient, tenant.Name, tenant.Name, dbList)
+	glog.Infoln("namespace " + tenant.Name + " left org " + tenant.Name + ", which is now the org of namespaces labeled " + tenantGroupLabel() + "=" + tenant.Name)
+}
+
+// tenantGroupLabel reads TENANT_GROUP_LABEL, the namespace label grouping namespaces into one tenant named after the label value.
+// It is the tenant label of Capsule if CAPSULE_ENABLED is true. Each namespace is its own tenant if it is empty.
+func tenantGroupLabel() string {
+	if capsuleEnabled() {
+		return capsuleTenantLabel
+	}
+	label := os.Getenv("TENANT_GROUP_LABEL")
+	return label
+}
@@ -0,0 +1,63 @@
+package controller
+
+import (
+	"os"
+	"reflect"
+	"testing"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func testNamespace(name string, labels map[string]string) v1.Namespace {
+	return v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name, Labels: labels}}
+}
+
+func TestGroupTenants(t *testing.T) {
+	os.Setenv("TENANT_GROUP_LABEL", "team")
+	defer os.Unsetenv("TENANT_GROUP_LABEL")
+	team := func(value string) map[string]string { return map[string]string{"team": value} }
+	tests := []struct {
+		name       string
+		namespaces []v1.Namespace
+		want       map[string][]string
+	}{
+		{
+			"ungrouped",
+			[]v1.Namespace{testNamespace("b", nil), testNamespace("a", nil)},
+			map[string][]string{"a": {"a"}, "b": {"b"}},
+		},
+		{
+			"grouped",
+			[]v1.Namespace{testNamespace("team-a-prod", team("team-a")), testNamespace("team-a-dev", team("team-a"))},
+			map[string][]string{"team-a": {"team-a-dev", "team-a-prod"}},
+		},
+		{
+			"grouped namespace named like its org",
+			[]v1.Namespace{testNamespace("team-a-prod", team("team-a")), testNamespace("team-a", team("team-a"))},
+			map[string][]string{"team-a": {"team-a", "team-a-prod"}},
+		},
+		{
+			"ungrouped namespace named like a grouped org",
+			[]v1.Namespace{testNamespace("team-a", nil), testNamespace("team-a-prod", team("team-a"))},
+			map[string][]string{"team-a": {"team-a-prod"}},
+		},
+		{
+			"empty label",
+			[]v1.Namespace{testNamespace("team-b", team("")), testNamespace("team-a-prod", team("team-a"))},
+			map[string][]string{"team-a": {"team-a-prod"}, "team-b": {"team-b"}},
+		},
+	}
+	for _, test := range tests {
+		got := make(map[string][]string)
+		for _, tenant := range groupTenants(test.namespaces) {
+			if _, ok := got[tenant.Name]; ok {
+				t.Errorf("%s: org %s is given to two tenants", test.name, tenant.Name)
+			}
+			got[tenant.Name] = tenant.NamespaceList()
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package controller
+
+import (
+	"k8s-grafana-controller/grafana"
+	"os"
+
+	"github.com/golang/glog"
+	"k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+)
+
+// apiTokenAnnotation on a namespace asks for a grafana API token of its org with the role in the value: Viewer, Editor or Admin
+const apiTokenAnnotation = "grafana-controller/api-token"
+
+// tokenRoleAnnotation of an API token secret is the role the token was issued with
+const tokenRoleAnnotation = "grafana-controller/token-role"
+
+// apiTokenIssuedAnnotation of a namespace tells an API token was issued for it, so the token is revoked even if its secret
+// was deleted, and namespaces that never had one are not looked up in grafana
+const apiTokenIssuedAnnotation = "grafana-controller/api-token-issued"
+
+// syncAPIToken issues an API token into the token secret of a namespace when the namespace asks for one, and revokes it
+// when the annotation is removed, whether or not the secret still exists. A new token is issued when the role changes,
+// the secret is deleted, or the service account of the token is gone from grafana.
+func syncAPIToken(clientset *kubernetes.Clientset, grafanaClient *grafana.GrafanaClient, ns *v1.Namespace) {
+	org := memberOrg(clientset, ns)
+	if org == "" {
+		return
+	}
+	role := ns.Annotations[apiTokenAnnotation]
+	secrets := clientset.CoreV1().Secrets(ns.Name)
+	secret, err := secrets.Get(apiTokenSecretName(), metav1.GetOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		glog.Error(err)
+		return
+	}
+	exists := err == nil
+	if role == "" {
+		// the token may have been copied before its secret was deleted, so the service account is always removed
+		if exists && secret.Annotations[tokenRoleAnnotation] != "" {
+			revokeAPIToken(clientset, grafanaClient, ns.Name, org)
+		} else if ns.Annotations[apiTokenIssuedAnnotation] != "" {
+			grafanaClient.RevokeTenantToken(org, serviceAccountName(ns.Name))
+		} else {
+			return
+		}
+		if ns.Annotations[apiTokenIssuedAnnotation] != "" {
+			removeNamespaceAnnotation(clientset, ns.Name, apiTokenIssuedAnnotation)
+		}
+		return
+	}
+	if exists && secret.Annotations[tokenRoleAnnotation] == role {
+		alive, err := grafanaClient.TenantTokenExists(org, serviceAccountName(ns.Name))
+		if err != nil {
+			glog.Warningln("fail to check api token of namespace " + ns.Name + ": " + err.Error())
+			return
+		}
+		if alive {
+			// tokens issued before the marker was set get it, so they are revoked even once their secret is deleted
+			if ns.Annotations[apiTokenIssuedAnnotation] == "" {
+				setNamespaceAnnotation(clientset, ns.Name, apiTokenIssuedAnnotation, true)
+			}
+			return
+		}
+		glog.Infoln("service account of the api token of namespace " + ns.Name + " is gone, issuing a new token")
+	}
+	token, err := grafanaClient.IssueTenantToken(org, serviceAccountName(ns.Name), role)
+	if err != nil {
+		glog.Errorln("fail to issue api token for namespace " + ns.Name + ": " + err.Error())
+		return
+	}
+	data := map[string][]byte{
+		"token": []byte(token),
+		"org":   []byte(org),
+		"url":   []byte("http://" + grafanaClient.GetGrafanaIP()),
+	}
+	if exists {
+		secret.Data = data
+		if secret.Annotations == nil {
+			secret.Annotations = make(map[string]string)
+		}
+		secret.Annotations[tokenRoleAnnotation] = role
+		_, err = secrets.Update(secret)
+	} else {
+		_, err = secrets.Create(&v1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: apiTokenSecretName(), Annotations: map[string]string{tokenRoleAnnotation: role}},
+			Data:       data,
+		})
+	}
+	if err != nil {
+		glog.Errorln("fail to store api token of namespace " + ns.Name + ", revoking it: " + err.Error())
+		grafanaClient.RevokeTenantToken(org, serviceAccountName(ns.Name))
+		return
+	}
+	if ns.Annotations[apiTokenIssuedAnnotation] == "" {
+		setNamespaceAnnotation(clientset, ns.Name, apiTokenIssuedAnnotation, true)
+	}
+	glog.Infoln("api token with role " + role + " issued for namespace " + ns.Name)
+}
+
+// revokeAPIToken deletes the service account of a namespace in an org, and the token secret if the namespace still exists
+func revokeAPIToken(clientset *kubernetes.Clientset, grafanaClient *grafana.GrafanaClient, namespace string, org string) {
+	grafanaClient.RevokeTenantToken(org, serviceAccountName(namespace))
+	err := clientset.CoreV1().Secrets(namespace).Delete(apiTokenSecretName(), &metav1.DeleteOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		glog.Error(err)
+	}
+	glog.Infoln("api token of namespace " + namespace + " revoked")
+}
+
+// WatchAPITokenSecrets watches the token secrets of all namespaces, and issues a new token when one is deleted from a
+// namespace still asking for it.
+func WatchAPITokenSecrets(clientset *kubernetes.Clientset, grafanaClient *grafana.GrafanaClient) {
+	watchSecrets, err := clientset.CoreV1().Secrets("").Watch(metav1.ListOptions{Watch: true, FieldSelector: "metadata.name=" + apiTokenSecretName()})
+	if err != nil {
+		glog.Fatal(err)
+	} else {
+		eventChan := watchSecrets.ResultChan()
+		for event := range eventChan {
+			secret, ok := event.Object.(*v1.Secret)
+			if !ok {
+				glog.Errorln("unexpected type when watching api token secrets")
+				continue
+			}
+			if event.Type != watch.Deleted {
+				continue
+			}
+			ns, err := clientset.CoreV1().Namespaces().Get(secret.Namespace, metav1.GetOptions{})
+			if err != nil {
+				if !apierrors.IsNotFound(err) {
+					glog.Error(err)
+				}
+				continue
+			}
+			if ns.Status.Phase == v1.NamespaceTerminating || ns.Annotations[apiTokenAnnotation] == "" {
+				continue
+			}
+			glog.Infoln("api token secret of namespace " + ns.Name + " deleted, issuing a new token")
+			syncAPIToken(clientset, grafanaClient, ns)
+		}
+	}
+	glog.Flush()
+}
+
+// serviceAccountName gives the name of the grafana service account of a namespace
+func serviceAccountName(namespace string) string {
+	return "namespace-" + namespace
+}
+
+// apiTokenSecretName reads API_TOKEN_SECRET, the name of the secret holding the API token in a namespace. The default is "grafana-api-token".
+func apiTokenSecretName() string {
+	name := os.Getenv("API_TOKEN_SECRET")
+	if name == "" {
+		return "grafana-api-token"
+	}
+	return name
+}
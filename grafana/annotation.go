@@ -0,0 +1,42 @@
+package grafana
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// PostTenantAnnotation posts an organization wide annotation to the organization of a tenant.
+// Dashboards show it with an annotation query of the Grafana data source filtered by one of its tags.
+func (c *GrafanaClient) PostTenantAnnotation(namespace string, at time.Time, tags []string, text string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	orgID := c.GetOrgID(namespace, c.GetGrafanaIP())
+	if orgID == 0 {
+		return
+	}
+	c.SwitchOrg(orgID, c.GetGrafanaIP())
+	c.PostAnnotation(at, tags, text, c.GetGrafanaIP())
+}
+
+// PostAnnotation posts an annotation to the current organization
+func (c *GrafanaClient) PostAnnotation(at time.Time, tags []string, text string, grafanaIP string) {
+	endpoint := "/api/annotations"
+	requestBody, _ := json.Marshal(map[string]interface{}{
+		"time": at.UnixNano() / int64(time.Millisecond),
+		"tags": tags,
+		"text": text,
+	})
+	url := "http://" + c.user + ":" + c.password + "@" + c.GetGrafanaIP() + endpoint
+	req, err := http.NewRequest("POST", url, bytes.NewBuffer(requestBody))
+	if err != nil {
+		glog.Error(err)
+	}
+	status, respBody := tryRequest(req, 3)
+	if !reqSuccess(status, respBody) {
+		glog.Warningln("fail to post annotation")
+	}
+}
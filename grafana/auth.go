@@ -0,0 +1,59 @@
+package grafana
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/golang/glog"
+)
+
+// AuthMapping maps external groups to org roles, for the generic_oauth and ldap authentication of grafana
+type AuthMapping struct {
+	// OrgMapping is the generic_oauth org_mapping, "group:orgId:role" separated by spaces
+	OrgMapping string
+	// LDAPGroupMappings are the [[servers.group_mappings]] of ldap.toml
+	LDAPGroupMappings string
+}
+
+// AuthMapping gives the mapping of groups to org roles, from the groups and roles of each tenant namespace. Tenants without an organization are skipped.
+func (c *GrafanaClient) AuthMapping(groups map[string]map[string]string) AuthMapping {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var namespaces []string
+	for namespace := range groups {
+		namespaces = append(namespaces, namespace)
+	}
+	sort.Strings(namespaces)
+	var orgMapping []string
+	var ldap []string
+	for _, namespace := range namespaces {
+		if len(groups[namespace]) == 0 {
+			continue
+		}
+		orgID := c.GetOrgID(namespace, c.GetGrafanaIP())
+		if orgID == 0 {
+			continue
+		}
+		var names []string
+		for group := range groups[namespace] {
+			names = append(names, group)
+		}
+		sort.Strings(names)
+		for _, group := range names {
+			role := groups[namespace][group]
+			if _, ok := roleRank[role]; !ok {
+				glog.Warningln("unknown role " + role + " of group " + group + " in org " + namespace)
+				continue
+			}
+			if strings.ContainsAny(group, ": ,") {
+				glog.Warningln("group " + group + " can not be used in org_mapping")
+			} else {
+				orgMapping = append(orgMapping, group+":"+strconv.Itoa(orgID)+":"+role)
+			}
+			ldap = append(ldap, "[[servers.group_mappings]]\ngroup_dn = "+strconv.Quote(group)+"\norg_role = "+strconv.Quote(role)+"\norg_id = "+strconv.Itoa(orgID)+"\n")
+		}
+	}
+	glog.Flush()
+	return AuthMapping{OrgMapping: strings.Join(orgMapping, " "), LDAPGroupMappings: strings.Join(ldap, "\n")}
+}
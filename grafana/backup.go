@@ -0,0 +1,53 @@
+package grafana
+
+import (
+	"errors"
+
+	"github.com/golang/glog"
+)
+
+// ExportTenant gets every dashboard in the organization of a tenant, including the ones built by hand, with their folders.
+// It returns no dashboards and no error if the organization does not exist.
+func (c *GrafanaClient) ExportTenant(namespace string) ([]Dashboard, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	orgID := c.GetOrgID(namespace, c.GetGrafanaIP())
+	if orgID == 0 {
+		return nil, nil
+	}
+	c.SwitchOrg(orgID, c.GetGrafanaIP())
+	allDbs := c.GetAllDashboards(c.GetGrafanaIP())
+	if allDbs == nil {
+		return nil, errors.New("fail to list dashboards of org " + namespace)
+	}
+	dbList := c.processDashboardList(allDbs)
+	glog.Flush()
+	return dbList, nil
+}
+
+// RestoreDashboards posts backed up dashboards to an organization, creating the organization and folders if they do not exist.
+func (c *GrafanaClient) RestoreDashboards(org string, dbList []Dashboard) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	orgID := c.GetOrgID(org, c.GetGrafanaIP())
+	if orgID == 0 {
+		c.PostOrg(org, c.GetGrafanaIP())
+		orgID = c.GetOrgID(org, c.GetGrafanaIP())
+	}
+	if orgID == 0 {
+		return errors.New("fail to post org " + org)
+	}
+	c.SwitchOrg(orgID, c.GetGrafanaIP())
+	for _, db := range dbList {
+		if db.Model == nil {
+			continue
+		}
+		var nullString *string
+		db.Model["id"] = nullString
+		folderID := c.ensureFolder(db)
+		c.ensureLibraryPanels(db, folderID, nil)
+		c.PostDashboard(dashboardRequest(db.Model, folderID), c.GetGrafanaIP())
+	}
+	glog.Flush()
+	return nil
+}
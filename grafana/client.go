@@ -3,15 +3,32 @@ package grafana
 import (
 	"encoding/json"
 	"errors"
-	"os"
+	"strconv"
+	"strings"
+	"sync"
 
 	"github.com/golang/glog"
 )
 
 type GrafanaClient struct {
-	GrafanaIP string
+	grafanaIP string
 	user      string
 	password  string
+	// mu serializes work that depends on the current organization of the client user
+	mu sync.Mutex
+	// ipMu guards grafanaIP, which changes when the grafana service moves
+	ipMu sync.RWMutex
+	// teamGrants holds the folder permission of each synced team by org, so folders created later get them too. It is guarded by mu.
+	teamGrants map[string]map[int]int
+}
+
+// Dashboard is a template dashboard of the main organization and the folder it is stored in.
+type Dashboard struct {
+	Model       map[string]interface{} `json:"dashboard"`
+	FolderUID   string                 `json:"folderUid,omitempty"`
+	FolderTitle string                 `json:"folderTitle,omitempty"`
+	// LibraryPanels are the library elements the dashboard uses
+	LibraryPanels []map[string]interface{} `json:"libraryPanels,omitempty"`
 }
 
 // NewGrafanaClient creates a new client to control grafana pod
@@ -26,49 +43,116 @@ func NewGrafanaClient(grafanaIP string, user string, password string) (*GrafanaC
 		return nil, errors.New("password is empty string")
 	}
 	return &GrafanaClient{
-		GrafanaIP: grafanaIP,
+		grafanaIP: grafanaIP,
 		user:      user,
 		password:  password,
 	}, nil
 }
 
+// SetGrafanaIP changes the host, or host:port, of grafana the client talks to
+func (c *GrafanaClient) SetGrafanaIP(grafanaIP string) {
+	c.ipMu.Lock()
+	defer c.ipMu.Unlock()
+	c.grafanaIP = grafanaIP
+}
+
+// GetGrafanaIP gives the host, or host:port, of grafana the client talks to
+func (c *GrafanaClient) GetGrafanaIP() string {
+	c.ipMu.RLock()
+	defer c.ipMu.RUnlock()
+	return c.grafanaIP
+}
+
 // PostTenant posts a new tenant to grafana.
-func (c *GrafanaClient) PostTenant(namespace string, dbList []map[string]interface{}) {
-	c.PostOrg(namespace, c.GrafanaIP)
-	orgID := c.GetOrgID(namespace, c.GrafanaIP)
+func (c *GrafanaClient) PostTenant(tenant Tenant, dbList []Dashboard) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	namespace := tenant.Name
+	c.PostOrg(namespace, c.GetGrafanaIP())
+	orgID := c.GetOrgID(namespace, c.GetGrafanaIP())
 	if orgID != 0 {
-		c.SwitchOrg(orgID, c.GrafanaIP)
-		c.PostPrometheusDataSource(c.GrafanaIP)
-		for _, db := range dbList {
-			dashboardStr := selectDashboard(db, namespace)
-			if dashboardStr != "" {
-				c.PostDashboard(dashboardStr, c.GrafanaIP)
-			}
-		}
-		c.PostUser(namespace, c.GrafanaIP)
-		c.PostUserToOrg(namespace, orgID, c.GrafanaIP, "Viewer")
-		c.PostUserToOrg(adminName(), orgID, c.GrafanaIP, "Admin")
-		userID := c.GetUserID(namespace, c.GrafanaIP)
-		c.SwitchUserContext(userID, orgID, c.GrafanaIP)
-		c.DeleteUserInOrg(userID, 1, c.GrafanaIP)
+		c.SwitchOrg(orgID, c.GetGrafanaIP())
+		c.putQuotas(tenant, orgID)
+		c.postDataSources(tenant)
+		c.postDashboards(tenant, dbList)
+		c.PostUser(namespace, c.GetGrafanaIP())
+		c.PostUserToOrg(namespace, orgID, c.GetGrafanaIP(), "Viewer")
+		userID := c.GetUserID(namespace, c.GetGrafanaIP())
+		c.SwitchUserContext(userID, orgID, c.GetGrafanaIP())
+		c.DeleteUserInOrg(userID, 1, c.GetGrafanaIP())
+		c.putPreferences(tenant)
+		c.putFolderPermissions(tenant)
 	}
 	glog.Flush()
 }
 
+// PostTenantDashboards posts missing data sources and the selected dashboards to the organization of an existing tenant and updates its quotas and preferences. Dashboards keep the uid of their template, so posting again updates them and moves them when the template folder changes.
+func (c *GrafanaClient) PostTenantDashboards(tenant Tenant, dbList []Dashboard) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	orgID := c.GetOrgID(tenant.Name, c.GetGrafanaIP())
+	if orgID != 0 {
+		c.SwitchOrg(orgID, c.GetGrafanaIP())
+		c.putQuotas(tenant, orgID)
+		c.postDataSources(tenant)
+		c.postDashboards(tenant, dbList)
+		c.putPreferences(tenant)
+		c.putFolderPermissions(tenant)
+		c.putTeamFolderPermissions(tenant, c.teamGrants[tenant.Name], nil)
+	}
+	glog.Flush()
+}
+
+// postDashboards posts the selected dashboards to the current organization, creating their folders first.
+// Templates are rendered for the tenant, and invalid dashboards are reported and skipped.
+func (c *GrafanaClient) postDashboards(tenant Tenant, dbList []Dashboard) {
+	namespace := tenant.Name
+	datasources := c.GetDataSources(c.GetGrafanaIP())
+	context := templateContext(tenant, datasources)
+	invalid := 0
+	for _, db := range dbList {
+		if !isSelected(db.Model) {
+			continue
+		}
+		dashboard, err := renderDashboard(db.Model, context)
+		if err != nil {
+			glog.Warningf("dashboard %v is not posted to org %s: %v", db.Model["title"], namespace, err)
+			invalid++
+			continue
+		}
+		if problems := validateDashboard(dashboard, dataSourceRefs(datasources)); len(problems) > 0 {
+			glog.Warningf("dashboard %v is not posted to org %s: %s", dashboard["title"], namespace, strings.Join(problems, "; "))
+			invalid++
+			continue
+		}
+		folderID := c.ensureFolder(db)
+		c.ensureLibraryPanels(db, folderID, &context)
+		dashboardStr := processDashboard(dashboard, tenant.namespaceRegex(), folderID)
+		c.PostDashboard(dashboardStr, c.GetGrafanaIP())
+	}
+	if invalid > 0 {
+		glog.Warningf("%d invalid dashboards are not posted to org %s", invalid, namespace)
+	}
+}
+
 // DeleteTenant deletes a tenant in Grafana
 func (c *GrafanaClient) DeleteTenant(namespace string) {
-	orgID := c.GetOrgID(namespace, c.GrafanaIP)
-	userID := c.GetUserID(namespace, c.GrafanaIP)
-	c.DeleteOrg(orgID, c.GrafanaIP)
-	c.DeleteUser(userID, c.GrafanaIP)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	orgID := c.GetOrgID(namespace, c.GetGrafanaIP())
+	userID := c.GetUserID(namespace, c.GetGrafanaIP())
+	c.DeleteOrg(orgID, c.GetGrafanaIP())
+	c.DeleteUser(userID, c.GetGrafanaIP())
 	glog.Flush()
 }
 
 // GetDashboardList gets all the dashboards in an organization
-func (c *GrafanaClient) GetDashboardList() []map[string]interface{} {
-	var dbList []map[string]interface{}
-	c.SwitchOrg(1, c.GrafanaIP)
-	allDbs := c.GetAllDashboards(c.GrafanaIP)
+func (c *GrafanaClient) GetDashboardList() []Dashboard {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var dbList []Dashboard
+	c.SwitchOrg(1, c.GetGrafanaIP())
+	allDbs := c.GetAllDashboards(c.GetGrafanaIP())
 	if allDbs == nil {
 		return nil
 	}
@@ -78,8 +162,8 @@ func (c *GrafanaClient) GetDashboardList() []map[string]interface{} {
 }
 
 // processDashboardList converts the dashboardlist string received to interface
-func (c *GrafanaClient) processDashboardList(dsData []byte) []map[string]interface{} {
-	var dbList []map[string]interface{}
+func (c *GrafanaClient) processDashboardList(dsData []byte) []Dashboard {
+	var dbList []Dashboard
 	var ds interface{}
 	err := json.Unmarshal(dsData, &ds)
 	if err != nil {
@@ -91,9 +175,24 @@ func (c *GrafanaClient) processDashboardList(dsData []byte) []map[string]interfa
 		for _, d := range r {
 			uid := d.(map[string]interface{})["uid"]
 			uidStr := uid.(string)
-			dashboard := c.GetDashboardByUID(uidStr, c.GrafanaIP)
+			dashboard := c.GetDashboardByUID(uidStr, c.GetGrafanaIP())
 			if dashboard != nil {
-				dbList = append(dbList, dashboard)
+				folderUID, _ := d.(map[string]interface{})["folderUid"].(string)
+				folderTitle, _ := d.(map[string]interface{})["folderTitle"].(string)
+				var libraryPanels []map[string]interface{}
+				for _, libraryUID := range libraryPanelUIDs(dashboard) {
+					if element := c.GetLibraryElement(libraryUID, c.GetGrafanaIP()); element != nil {
+						libraryPanels = append(libraryPanels, element)
+					} else {
+						glog.Warningln("library panel " + libraryUID + " of dashboard " + uidStr + " not found")
+					}
+				}
+				dbList = append(dbList, Dashboard{
+					Model:         dashboard,
+					FolderUID:     folderUID,
+					FolderTitle:   folderTitle,
+					LibraryPanels: libraryPanels,
+				})
 			}
 		}
 	}
@@ -101,49 +200,46 @@ func (c *GrafanaClient) processDashboardList(dsData []byte) []map[string]interfa
 	return dbList
 }
 
-// select Deployment, Pods and StatefulSet, then modify the selected dashboards
-func selectDashboard(dashboard map[string]interface{}, namespace string) string {
+// select Deployment, Pods and StatefulSet dashboards for tenants
+func isSelected(dashboard map[string]interface{}) bool {
 	switch dashboard["title"] {
-	case "Deployment":
-		dbstr := processDashboard(dashboard, namespace)
-		return dbstr
-	case "Pods":
-		dbstr := processDashboard(dashboard, namespace)
-		return dbstr
-	case "StatefulSet":
-		dbstr := processDashboard(dashboard, namespace)
-		return dbstr
-	case "平台监控":
-		dbstr := processDashboard(dashboard, namespace)
-		return dbstr
+	case "Deployment", "Pods", "StatefulSet", "平台监控":
+		return true
 	default:
-		return ""
+		return false
 	}
 }
 
-// modify dashboard before post them to grafana
-func processDashboard(dashboard map[string]interface{}, namespace string) string {
+// modify dashboard before post them to grafana. The uid of the template is kept so the dashboard can be overwritten later.
+func processDashboard(dashboard map[string]interface{}, namespaceRegex string, folderID int) string {
 	var nullString *string
 	dashboard["id"] = nullString
-	dashboard["uid"] = nullString
 	dashboard["version"] = 0
-	templates := dashboard["templating"].(map[string]interface{})
-	temp := processTemplate(templates, namespace)
-	dashboard["templating"] = temp
+	if templates, ok := dashboard["templating"].(map[string]interface{}); ok {
+		temp := processTemplate(templates, namespaceRegex)
+		dashboard["templating"] = temp
+	}
+	dbstr := dashboardRequest(dashboard, folderID)
+	glog.Flush()
+	return dbstr
+}
+
+// dashboardRequest wraps dashboard json into the request body of PostDashboard
+func dashboardRequest(dashboard map[string]interface{}, folderID int) string {
 	db, err := json.Marshal(dashboard)
 	if err != nil {
 		glog.Warningln("unable to marshal dashboard")
 	}
-	var dbstr string
-	dbstr = "{\"dashboard\":" + string(db) + ", \"overwrite\": false}"
-	glog.Flush()
-	return dbstr
+	return "{\"dashboard\":" + string(db) + ", \"folderId\": " + strconv.Itoa(folderID) + ", \"overwrite\": true}"
 }
 
-// add namespace to dashboard template regex
-func processTemplate(template map[string]interface{}, namespace string) map[string]interface{} {
-	tempList := template["list"].([]interface{})
+// add namespaces to dashboard template regex
+func processTemplate(template map[string]interface{}, namespaceRegex string) map[string]interface{} {
+	tempList, _ := template["list"].([]interface{})
 	for _, t := range tempList {
+		if _, ok := t.(map[string]interface{}); !ok {
+			continue
+		}
 		allValue := t.(map[string]interface{})["allValue"]
 		if allValue != nil {
 			var nullString *string
@@ -151,9 +247,9 @@ func processTemplate(template map[string]interface{}, namespace string) map[stri
 		}
 		label := t.(map[string]interface{})["label"]
 		if label != nil {
-			labelStr := label.(string)
+			labelStr, _ := label.(string)
 			if labelStr == "Namespace" {
-				t.(map[string]interface{})["regex"] = namespace
+				t.(map[string]interface{})["regex"] = namespaceRegex
 				t.(map[string]interface{})["hide"] = 2
 			}
 		}
@@ -162,8 +258,3 @@ func processTemplate(template map[string]interface{}, namespace string) map[stri
 	result["list"] = tempList
 	return result
 }
-
-func adminName() string {
-	name := os.Getenv("ADMIN_NAME")
-	return name
-}
@@ -0,0 +1,223 @@
+package grafana
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/golang/glog"
+)
+
+// PostConfigMapDashboards posts the dashboards of a ConfigMap in a tenant namespace to the tenant organization.
+// Each key of data holds one dashboard json. Dashboards are tagged with the ConfigMap name, so the ones removed from the ConfigMap are deleted.
+// Dashboards tagged tenant-template are rendered for the tenant. Invalid dashboards are not posted, and their problems are returned by key.
+func (c *GrafanaClient) PostConfigMapDashboards(tenant Tenant, namespace string, configMap string, folder string, data map[string]string) map[string][]string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	orgID := c.GetOrgID(tenant.Name, c.GetGrafanaIP())
+	if orgID == 0 {
+		return nil
+	}
+	c.SwitchOrg(orgID, c.GetGrafanaIP())
+	datasources := c.GetDataSources(c.GetGrafanaIP())
+	context := templateContext(tenant, datasources)
+	tag := configMapTag(tenant.Name, namespace, configMap)
+	posted := make(map[string]bool)
+	invalid := make(map[string][]string)
+	for key, value := range data {
+		var dashboard map[string]interface{}
+		err := json.Unmarshal([]byte(value), &dashboard)
+		if err != nil {
+			invalid[key] = []string{"invalid json: " + err.Error()}
+			continue
+		}
+		// uids are derived from the namespace and ConfigMap, so a ConfigMap can not replace dashboards it does not own
+		id, _ := dashboard["uid"].(string)
+		if id == "" {
+			id = key
+		}
+		uid := configMapDashboardUID(namespace, configMap, id)
+		dashboard["uid"] = uid
+		dashboard, err = renderDashboard(dashboard, context)
+		if err != nil {
+			invalid[key] = []string{"fail to render template: " + err.Error()}
+			posted[uid] = true
+			continue
+		}
+		if problems := validateDashboard(dashboard, dataSourceRefs(datasources)); len(problems) > 0 {
+			invalid[key] = problems
+			// keep the dashboard posted before
+			posted[uid] = true
+			continue
+		}
+		dashboard["tags"] = appendTag(dashboard["tags"], tag)
+		// the folder annotation of the ConfigMap wins over DASHBOARD_FOLDER
+		folderID := c.ensureFolder(Dashboard{Model: dashboard})
+		if folder != "" {
+			folderID = c.ensureFolderByTitle(folder)
+		}
+		c.PostDashboard(processDashboard(dashboard, tenant.namespaceRegex(), folderID), c.GetGrafanaIP())
+		posted[uid] = true
+	}
+	for _, uid := range c.GetDashboardUIDsByTag(tag, c.GetGrafanaIP()) {
+		if !posted[uid] && isConfigMapDashboardUID(uid) {
+			c.DeleteDashboardByUID(uid, c.GetGrafanaIP())
+		}
+	}
+	c.putFolderPermissions(tenant)
+	c.putTeamFolderPermissions(tenant, c.teamGrants[tenant.Name], nil)
+	for key, problems := range invalid {
+		glog.Warningln("dashboard " + key + " in configmap " + namespace + "/" + configMap + " is not posted: " + strings.Join(problems, "; "))
+	}
+	glog.Flush()
+	return invalid
+}
+
+// DeleteConfigMapDashboards deletes the dashboards posted from a ConfigMap in a namespace of a tenant organization
+func (c *GrafanaClient) DeleteConfigMapDashboards(org string, namespace string, configMap string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	orgID := c.GetOrgID(org, c.GetGrafanaIP())
+	if orgID == 0 {
+		return
+	}
+	c.SwitchOrg(orgID, c.GetGrafanaIP())
+	for _, uid := range c.GetDashboardUIDsByTag(configMapTag(org, namespace, configMap), c.GetGrafanaIP()) {
+		if isConfigMapDashboardUID(uid) {
+			c.DeleteDashboardByUID(uid, c.GetGrafanaIP())
+		}
+	}
+	glog.Flush()
+}
+
+// DeleteNamespaceConfigMapDashboards deletes the dashboards posted from all the ConfigMaps of a namespace that left a tenant
+// organization, found by the namespace in their tags, so it works after the ConfigMaps are gone
+func (c *GrafanaClient) DeleteNamespaceConfigMapDashboards(org string, namespace string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	orgID := c.GetOrgID(org, c.GetGrafanaIP())
+	if orgID == 0 {
+		return
+	}
+	c.SwitchOrg(orgID, c.GetGrafanaIP())
+	prefix := configMapTag(org, namespace, "")
+	for uid, tags := range c.GetDashboardTags(c.GetGrafanaIP()) {
+		if !isConfigMapDashboardUID(uid) {
+			continue
+		}
+		for _, tag := range tags {
+			if strings.HasPrefix(tag, prefix) {
+				c.DeleteDashboardByUID(uid, c.GetGrafanaIP())
+				break
+			}
+		}
+	}
+	glog.Flush()
+}
+
+// GetDashboardTags gets the tags of every dashboard in the current organization by uid
+func (c *GrafanaClient) GetDashboardTags(grafanaIP string) map[string][]string {
+	endpoint := "/api/search?type=dash-db&limit=5000"
+	url := "http://" + c.user + ":" + c.password + "@" + c.GetGrafanaIP() + endpoint
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		glog.Error(err)
+	}
+	status, respBody := tryRequest(req, 3)
+	if !reqSuccess(status, respBody) {
+		glog.Warningln("fail to search dashboards")
+		return nil
+	}
+	var result []struct {
+		UID  string   `json:"uid"`
+		Tags []string `json:"tags"`
+	}
+	err = json.Unmarshal(respBody, &result)
+	if err != nil {
+		glog.Error(err)
+		return nil
+	}
+	tags := make(map[string][]string)
+	for _, d := range result {
+		tags[d.UID] = d.Tags
+	}
+	return tags
+}
+
+// GetDashboardUIDsByTag gets the uids of the dashboards with a tag in the current organization
+func (c *GrafanaClient) GetDashboardUIDsByTag(tag string, grafanaIP string) []string {
+	endpoint := "/api/search?type=dash-db&tag=" + url.QueryEscape(tag)
+	url := "http://" + c.user + ":" + c.password + "@" + c.GetGrafanaIP() + endpoint
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		glog.Error(err)
+	}
+	status, respBody := tryRequest(req, 3)
+	if !reqSuccess(status, respBody) {
+		glog.Warningln("fail to search dashboards with tag " + tag)
+		return nil
+	}
+	var result []map[string]interface{}
+	err = json.Unmarshal(respBody, &result)
+	if err != nil {
+		glog.Error(err)
+		return nil
+	}
+	var uids []string
+	for _, d := range result {
+		if uid, ok := d["uid"].(string); ok {
+			uids = append(uids, uid)
+		}
+	}
+	return uids
+}
+
+// DeleteDashboardByUID deletes a dashboard in the current organization
+func (c *GrafanaClient) DeleteDashboardByUID(uid string, grafanaIP string) {
+	endpoint := "/api/dashboards/uid/" + uid
+	url := "http://" + c.user + ":" + c.password + "@" + c.GetGrafanaIP() + endpoint
+	req, err := http.NewRequest("DELETE", url, nil)
+	if err != nil {
+		glog.Error(err)
+	}
+	status, respBody := tryRequest(req, 3)
+	if !reqSuccess(status, respBody) {
+		glog.Warningln("fail to delete dashboard " + uid)
+	}
+}
+
+// configMapTag tags the dashboards of a ConfigMap. ConfigMaps of tenants grouped by label are told apart by their namespace.
+func configMapTag(org string, namespace string, configMap string) string {
+	if namespace != org {
+		return "configmap:" + namespace + "/" + configMap
+	}
+	return "configmap:" + configMap
+}
+
+// configMapUIDPrefix starts the uids of ConfigMap dashboards, so dashboards made by hand are never deleted with them
+const configMapUIDPrefix = "cm-"
+
+// configMapDashboardUID gives a ConfigMap dashboard a stable uid from its own uid, or its key if it has none, so updating
+// the ConfigMap updates the same dashboard. Grafana uids are at most 40 characters.
+func configMapDashboardUID(namespace string, configMap string, id string) string {
+	sum := sha1.Sum([]byte(namespace + "/" + configMap + "/" + id))
+	return (configMapUIDPrefix + hex.EncodeToString(sum[:]))[:40]
+}
+
+// isConfigMapDashboardUID tells if a uid was given to a ConfigMap dashboard by the controller
+func isConfigMapDashboardUID(uid string) bool {
+	return strings.HasPrefix(uid, configMapUIDPrefix) && len(uid) == 40
+}
+
+func appendTag(tags interface{}, tag string) []interface{} {
+	list, _ := tags.([]interface{})
+	for _, t := range list {
+		if t == tag {
+			return list
+		}
+	}
+	return append(list, tag)
+}
@@ -7,6 +7,7 @@ import (
 	"net/http"
 	"os"
 	"strconv"
+	"sync"
 
 	"github.com/golang/glog"
 )
@@ -15,7 +16,7 @@ import (
 func (c *GrafanaClient) PostDashboard(dashboardStr string, grafanaIP string) {
 	endpoint := "/api/dashboards/db"
 	var requestBody = []byte(dashboardStr)
-	url := "http://" + c.user + ":" + c.password + "@" + c.GrafanaIP + endpoint
+	url := "http://" + c.user + ":" + c.password + "@" + c.GetGrafanaIP() + endpoint
 	req, err := http.NewRequest("POST", url, bytes.NewBuffer(requestBody))
 	if err != nil {
 		glog.Error(err)
@@ -29,7 +30,7 @@ func (c *GrafanaClient) PostDashboard(dashboardStr string, grafanaIP string) {
 // GetAllDashboards gets all the dashboards in an organization. The received json does not include dashboard json data. To get dashboard json, use the uids you got and call GetDashboardByUID.
 func (c *GrafanaClient) GetAllDashboards(grafanaIP string) []byte {
 	endpoint := "/api/search?type=dash-db&query=&starred=false"
-	url := "http://" + c.user + ":" + c.password + "@" + c.GrafanaIP + endpoint
+	url := "http://" + c.user + ":" + c.password + "@" + c.GetGrafanaIP() + endpoint
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
 		glog.Error(err)
@@ -45,7 +46,7 @@ func (c *GrafanaClient) GetAllDashboards(grafanaIP string) []byte {
 // GetDashboardByUID gets the dashboard json from grafana and marshals the received string
 func (c *GrafanaClient) GetDashboardByUID(uid string, grafanaIP string) map[string]interface{} {
 	endpoint := "/api/dashboards/uid/" + uid
-	url := "http://" + c.user + ":" + c.password + "@" + c.GrafanaIP + endpoint
+	url := "http://" + c.user + ":" + c.password + "@" + c.GetGrafanaIP() + endpoint
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
 		glog.Error(err)
@@ -67,7 +68,7 @@ func (c *GrafanaClient) GetDashboardByUID(uid string, grafanaIP string) map[stri
 
 func (c *GrafanaClient) DeleteUser(userID int, grafanaIP string) {
 	endpoint := "/api/admin/users/" + strconv.Itoa(userID)
-	url := "http://" + c.user + ":" + c.password + "@" + c.GrafanaIP + endpoint
+	url := "http://" + c.user + ":" + c.password + "@" + c.GetGrafanaIP() + endpoint
 	req, err := http.NewRequest("DELETE", url, nil)
 	if err != nil {
 		glog.Error(err)
@@ -80,7 +81,7 @@ func (c *GrafanaClient) DeleteUser(userID int, grafanaIP string) {
 
 func (c *GrafanaClient) DeleteOrg(orgID int, grafanaIP string) {
 	endpoint := "/api/orgs/" + strconv.Itoa(orgID)
-	url := "http://" + c.user + ":" + c.password + "@" + c.GrafanaIP + endpoint
+	url := "http://" + c.user + ":" + c.password + "@" + c.GetGrafanaIP() + endpoint
 	req, err := http.NewRequest("DELETE", url, nil)
 	if err != nil {
 		glog.Error(err)
@@ -94,7 +95,7 @@ func (c *GrafanaClient) DeleteOrg(orgID int, grafanaIP string) {
 // PutUserPermissionToAdmin puts a user to server admin
 func (c *GrafanaClient) PutUserPermissionToAdmin(userID int, grafanaIP string) {
 	endpoint := "/api/admin/users/" + strconv.Itoa(userID) + "/permissions"
-	url := "http://" + c.user + ":" + c.password + "@" + c.GrafanaIP + endpoint
+	url := "http://" + c.user + ":" + c.password + "@" + c.GetGrafanaIP() + endpoint
 	var requestBody = []byte(`{"isGrafanaAdmin": true}`)
 	req, err := http.NewRequest("PUT", url, bytes.NewBuffer(requestBody))
 	if err != nil {
@@ -106,9 +107,10 @@ func (c *GrafanaClient) PutUserPermissionToAdmin(userID int, grafanaIP string) {
 	}
 }
 
-func (c *GrafanaClient) PutUserPassword(userID int, grafanaIP string, password string) {
+// PutUserPassword sets the password of a user. It returns whether the password was changed.
+func (c *GrafanaClient) PutUserPassword(userID int, grafanaIP string, password string) bool {
 	endpoint := "/api/admin/users/" + strconv.Itoa(userID) + "/password"
-	url := "http://" + c.user + ":" + c.password + "@" + c.GrafanaIP + endpoint
+	url := "http://" + c.user + ":" + c.password + "@" + c.GetGrafanaIP() + endpoint
 	var requestBody = []byte(`{"password":"` + password + `"}`)
 	req, err := http.NewRequest("PUT", url, bytes.NewBuffer(requestBody))
 	if err != nil {
@@ -117,14 +119,16 @@ func (c *GrafanaClient) PutUserPassword(userID int, grafanaIP string, password s
 	status, respBody := tryRequest(req, 3)
 	if !reqSuccess(status, respBody) {
 		glog.Warningln("fail to put user password")
+		return false
 	}
+	return true
 }
 
 // PostOrg adds a new organization
 func (c *GrafanaClient) PostOrg(name string, grafanaIP string) {
 	var requestBody = []byte(`{"name":"` + name + `"}`)
 	endpoint := "/api/orgs"
-	url := "http://" + c.user + ":" + c.password + "@" + c.GrafanaIP + endpoint
+	url := "http://" + c.user + ":" + c.password + "@" + c.GetGrafanaIP() + endpoint
 	req, err := http.NewRequest("POST", url, bytes.NewBuffer(requestBody))
 	if err != nil {
 		glog.Error(err)
@@ -135,13 +139,10 @@ func (c *GrafanaClient) PostOrg(name string, grafanaIP string) {
 	}
 }
 
-// PostPrometheusDataSource adds a prometheus data source to the current organization. The prometheus ip address is read through environment variable PROMETHEUS_IP. If you have a DNS, you can change the url in request body to "http://{your prometheus service name}:9090" and delete the environment variable.
-func (c *GrafanaClient) PostPrometheusDataSource(grafanaIP string) {
+// PostDataSource adds a data source to the current organization
+func (c *GrafanaClient) PostDataSource(requestBody []byte, grafanaIP string) {
 	endpoint := "/api/datasources"
-	prometheus := prometheusIP() + ":9090"
-	var requestBody = []byte(`{"name":"prometheus","type":"prometheus","url":"http://` + prometheus + `","access":"proxy"}`)
-
-	url := "http://" + c.user + ":" + c.password + "@" + c.GrafanaIP + endpoint
+	url := "http://" + c.user + ":" + c.password + "@" + c.GetGrafanaIP() + endpoint
 	req, err := http.NewRequest("POST", url, bytes.NewBuffer(requestBody))
 	if err != nil {
 		glog.Error(err)
@@ -156,7 +157,7 @@ func (c *GrafanaClient) PostPrometheusDataSource(grafanaIP string) {
 func (c *GrafanaClient) PostUser(name string, grafanaIP string) {
 	endpoint := "/api/admin/users"
 	var requestBody = []byte(`{"name":"` + name + `","login":"` + name + `","password":"password"}`)
-	url := "http://" + c.user + ":" + c.password + "@" + c.GrafanaIP + endpoint
+	url := "http://" + c.user + ":" + c.password + "@" + c.GetGrafanaIP() + endpoint
 	req, err := http.NewRequest("POST", url, bytes.NewBuffer(requestBody))
 	if err != nil {
 		glog.Error(err)
@@ -170,7 +171,7 @@ func (c *GrafanaClient) PostUser(name string, grafanaIP string) {
 func (c *GrafanaClient) GetUserID(name string, grafanaIP string) int {
 	var id int = 0
 	endpoint := "/api/users/lookup?loginOrEmail=" + name
-	url := "http://" + c.user + ":" + c.password + "@" + c.GrafanaIP + endpoint
+	url := "http://" + c.user + ":" + c.password + "@" + c.GetGrafanaIP() + endpoint
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
 		glog.Error(err)
@@ -189,7 +190,7 @@ func (c *GrafanaClient) GetUserID(name string, grafanaIP string) int {
 func (c *GrafanaClient) GetOrgID(name string, grafanaIP string) int {
 	var id int = 0
 	endpoint := "/api/orgs/name/" + name
-	url := "http://" + c.user + ":" + c.password + "@" + c.GrafanaIP + endpoint
+	url := "http://" + c.user + ":" + c.password + "@" + c.GetGrafanaIP() + endpoint
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
 		glog.Error(err)
@@ -208,7 +209,7 @@ func (c *GrafanaClient) GetOrgID(name string, grafanaIP string) int {
 // SwitchOrg changes the current organization of the client user.
 func (c *GrafanaClient) SwitchOrg(orgID int, grafanaIP string) {
 	endpoint := "/api/user/using/" + strconv.Itoa(orgID)
-	url := "http://" + c.user + ":" + c.password + "@" + c.GrafanaIP + endpoint
+	url := "http://" + c.user + ":" + c.password + "@" + c.GetGrafanaIP() + endpoint
 	req, err := http.NewRequest("POST", url, nil)
 	if err != nil {
 		glog.Error(err)
@@ -223,7 +224,7 @@ func (c *GrafanaClient) SwitchOrg(orgID int, grafanaIP string) {
 func (c *GrafanaClient) PostUserToOrg(name string, orgID int, grafanaIP string, role string) {
 	endpoint := "/api/orgs/" + strconv.Itoa(orgID) + "/users"
 	var requestBody = []byte(`{"loginOrEmail":"` + name + `","role":"` + role + `"}`)
-	url := "http://" + c.user + ":" + c.password + "@" + c.GrafanaIP + endpoint
+	url := "http://" + c.user + ":" + c.password + "@" + c.GetGrafanaIP() + endpoint
 	req, err := http.NewRequest("POST", url, bytes.NewBuffer(requestBody))
 	if err != nil {
 		glog.Error(err)
@@ -237,7 +238,7 @@ func (c *GrafanaClient) PostUserToOrg(name string, orgID int, grafanaIP string,
 // SwitchUserContext changes the current organization of a user. To call this, the client user must be server admin.
 func (c *GrafanaClient) SwitchUserContext(userID int, orgID int, grafanaIP string) {
 	endpoint := "/api/users/" + strconv.Itoa(userID) + "/using/" + strconv.Itoa(orgID)
-	url := "http://" + c.user + ":" + c.password + "@" + c.GrafanaIP + endpoint
+	url := "http://" + c.user + ":" + c.password + "@" + c.GetGrafanaIP() + endpoint
 	req, err := http.NewRequest("POST", url, nil)
 	if err != nil {
 		glog.Error(err)
@@ -250,7 +251,7 @@ func (c *GrafanaClient) SwitchUserContext(userID int, orgID int, grafanaIP strin
 
 func (c *GrafanaClient) DeleteUserInOrg(userID int, orgID int, grafanaIP string) {
 	endpoint := "/api/orgs/" + strconv.Itoa(orgID) + "/users/" + strconv.Itoa(userID)
-	url := "http://" + c.user + ":" + c.password + "@" + c.GrafanaIP + endpoint
+	url := "http://" + c.user + ":" + c.password + "@" + c.GetGrafanaIP() + endpoint
 	req, err := http.NewRequest("DELETE", url, nil)
 	if err != nil {
 		glog.Error(err)
@@ -308,6 +309,29 @@ func request(req *http.Request) (string, []byte, error) {
 	return status, body, nil
 }
 
+// prometheusAddr is the address of the prometheus service set by SetPrometheusAddress
+var prometheusAddr struct {
+	sync.Mutex
+	address string
+}
+
+// SetPrometheusAddress sets the host:port of prometheus used by the default data source, overriding PROMETHEUS_IP
+func SetPrometheusAddress(address string) {
+	prometheusAddr.Lock()
+	defer prometheusAddr.Unlock()
+	prometheusAddr.address = address
+}
+
+// prometheusAddress gives the host:port of prometheus, from SetPrometheusAddress or else PROMETHEUS_IP
+func prometheusAddress() string {
+	prometheusAddr.Lock()
+	defer prometheusAddr.Unlock()
+	if prometheusAddr.address != "" {
+		return prometheusAddr.address
+	}
+	return prometheusIP() + ":9090"
+}
+
 func prometheusIP() string {
 	ip := os.Getenv("PROMETHEUS_IP")
 	return ip
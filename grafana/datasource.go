@@ -0,0 +1,445 @@
+package grafana
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/golang/glog"
+)
+
+// secureHashKey is the jsonData key of the hash of secureJsonData
+const secureHashKey = "grafanaControllerSecureHash"
+
+// lokiLabelPolicyHeader carries the stream selector a label enforcing loki gateway adds to every query of a tenant
+const lokiLabelPolicyHeader = "X-Prom-Label-Policy"
+
+// GetDataSources gets the data sources in the current organization. It returns nil if the request fails.
+func (c *GrafanaClient) GetDataSources(grafanaIP string) []map[string]interface{} {
+	endpoint := "/api/datasources"
+	url := "http://" + c.user + ":" + c.password + "@" + c.GetGrafanaIP() + endpoint
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		glog.Error(err)
+	}
+	status, respBody := tryRequest(req, 3)
+	if !reqSuccess(status, respBody) {
+		glog.Warningln("fail to get data sources")
+		return nil
+	}
+	var list []map[string]interface{}
+	err = json.Unmarshal(respBody, &list)
+	if err != nil {
+		glog.Error(err)
+		return nil
+	}
+	return list
+}
+
+// dataSourceRefs collects the names and uids data sources can be referenced by
+func dataSourceRefs(list []map[string]interface{}) dataSources {
+	if list == nil {
+		return nil
+	}
+	result := make(dataSources)
+	for _, ds := range list {
+		if name, ok := ds["name"].(string); ok {
+			result[name] = true
+		}
+		if uid, ok := ds["uid"].(string); ok && uid != "" {
+			result[uid] = true
+		}
+	}
+	return result
+}
+
+// DataSource defines a data source provisioned into every tenant organization. Strings in the definition are rendered
+// like dashboard templates, e.g. "url": "http://loki-{% .Namespace %}:3100".
+type DataSource struct {
+	Name      string                 `json:"name"`
+	UID       string                 `json:"uid,omitempty"`
+	Type      string                 `json:"type"`
+	URL       string                 `json:"url"`
+	Access    string                 `json:"access,omitempty"`
+	IsDefault bool                   `json:"isDefault,omitempty"`
+	Database  string                 `json:"database,omitempty"`
+	JSONData  map[string]interface{} `json:"jsonData,omitempty"`
+	// ScopeLabel restricts queries to the namespaces of the tenant through a label enforcing proxy. Prometheus queries get
+	// the query parameter <ScopeLabel>=<namespace> for each namespace of the tenant, for prom-label-proxy. Loki queries get
+	// the X-Prom-Label-Policy header with the tenant id and the selector {<ScopeLabel>=~"<namespaces>"}, for a gateway
+	// such as the one of Grafana Enterprise Logs.
+	ScopeLabel string `json:"scopeLabel,omitempty"`
+	// Headers are sent with every query, e.g. {"X-Scope-OrgID": "{% .TenantID %}"} for Cortex, Mimir, Thanos or Loki
+	Headers       map[string]string `json:"headers,omitempty"`
+	BasicAuth     bool              `json:"basicAuth,omitempty"`
+	BasicAuthUser string            `json:"basicAuthUser,omitempty"`
+	// Credentials are read from kubernetes secrets into secureJsonData. The keys are basicAuthPassword, bearerToken,
+	// tlsClientCert, tlsClientKey, tlsCACert, or any other secureJsonData field.
+	Credentials map[string]SecretRef `json:"credentials,omitempty"`
+}
+
+// SecretRef points to a key of a kubernetes secret. Namespace and name are rendered like dashboard templates.
+type SecretRef struct {
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+	Key       string `json:"key"`
+}
+
+// secretReader reads the value of a key of a kubernetes secret
+var secretReader func(namespace string, name string, key string) (string, error)
+
+// SetSecretReader sets how data source credentials are read from kubernetes secrets
+func SetSecretReader(reader func(namespace string, name string, key string) (string, error)) {
+	secretReader = reader
+}
+
+// PostTenantDataSources adds and updates the data sources of the organization of a tenant
+func (c *GrafanaClient) PostTenantDataSources(tenant Tenant) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	orgID := c.GetOrgID(tenant.Name, c.GetGrafanaIP())
+	if orgID != 0 {
+		c.SwitchOrg(orgID, c.GetGrafanaIP())
+		c.postDataSources(tenant)
+	}
+	glog.Flush()
+}
+
+// postDataSources adds the data sources of DATASOURCES missing in the current organization, and updates the ones that
+// differ from their definition and the ones with headers
+func (c *GrafanaClient) postDataSources(tenant Tenant) {
+	context := templateContext(tenant, nil)
+	for _, def := range dataSourceDefinitions() {
+		body, err := tenantDataSource(def, context)
+		if err != nil {
+			glog.Warningln("fail to render data source " + def.Name + " for org " + tenant.Name + ": " + err.Error())
+			continue
+		}
+		c.hashSecureJSONData(body)
+		existing := c.getRenderedDataSource(body)
+		requestBody, _ := json.Marshal(body)
+		if existing == nil {
+			c.PostDataSource(requestBody, c.GetGrafanaIP())
+			continue
+		}
+		// an org Admin can change the headers scoping the tenant in secureJsonData without changing their hash, so data
+		// sources with headers are always put again
+		drifted := dataSourceDrifted(existing, body)
+		if !drifted && !scopedByHeaders(def) {
+			continue
+		}
+		id, _ := existing["id"].(float64)
+		if body["uid"] == nil {
+			body["uid"] = existing["uid"]
+			requestBody, _ = json.Marshal(body)
+		}
+		c.PutDataSource(int(id), requestBody, c.GetGrafanaIP())
+		if drifted {
+			name, _ := body["name"].(string)
+			glog.Infoln("data source " + name + " of org " + tenant.Name + " updated")
+		}
+	}
+}
+
+// getRenderedDataSource gets the existing data source of a rendered definition in the current organization, by its
+// rendered uid or else its rendered name. It returns nil if there is none.
+func (c *GrafanaClient) getRenderedDataSource(body map[string]interface{}) map[string]interface{} {
+	if uid, _ := body["uid"].(string); uid != "" {
+		if existing := c.GetDataSource("uid/"+url.PathEscape(uid), c.GetGrafanaIP()); existing != nil {
+			return existing
+		}
+	}
+	name, _ := body["name"].(string)
+	return c.GetDataSource("name/"+url.PathEscape(name), c.GetGrafanaIP())
+}
+
+// dataSourceDrifted tells if the settings of an existing data source differ from the desired ones.
+// Secure fields can not be read, so they are compared by the hash kept in jsonData. Keys of jsonData that are not in the
+// definition are ignored.
+func dataSourceDrifted(existing map[string]interface{}, desired map[string]interface{}) bool {
+	for _, field := range []string{"type", "url", "access", "database", "isDefault", "basicAuth", "basicAuthUser"} {
+		want := desired[field]
+		if want == nil && (field == "isDefault" || field == "basicAuth") {
+			want = false
+		}
+		if want == nil {
+			want = ""
+		}
+		if !reflect.DeepEqual(existing[field], want) {
+			return true
+		}
+	}
+	// grafana adds defaults such as httpMethod to jsonData, so only the keys of the definition are compared
+	jsonData, _ := existing["jsonData"].(map[string]interface{})
+	wantJSONData, _ := desired["jsonData"].(map[string]interface{})
+	for key, want := range wantJSONData {
+		if !reflect.DeepEqual(jsonData[key], want) {
+			return true
+		}
+	}
+	// secure fields that were removed from the definition
+	_, hashed := jsonData[secureHashKey]
+	_, wantHashed := wantJSONData[secureHashKey]
+	return hashed && !wantHashed
+}
+
+// hashSecureJSONData keeps a hash of the secure fields of a data source in its jsonData, to notice when they change
+func (c *GrafanaClient) hashSecureJSONData(body map[string]interface{}) {
+	secureJSONData, _ := body["secureJsonData"].(map[string]interface{})
+	if len(secureJSONData) == 0 {
+		return
+	}
+	raw, _ := json.Marshal(secureJSONData)
+	mac := hmac.New(sha256.New, []byte(c.password))
+	mac.Write(raw)
+	jsonData, _ := body["jsonData"].(map[string]interface{})
+	if jsonData == nil {
+		jsonData = make(map[string]interface{})
+		body["jsonData"] = jsonData
+	}
+	jsonData[secureHashKey] = hex.EncodeToString(mac.Sum(nil))
+}
+
+// GetDataSource gets a data source of the current organization by "name/<name>" or "uid/<uid>". It returns nil if the data source does not exist.
+func (c *GrafanaClient) GetDataSource(ref string, grafanaIP string) map[string]interface{} {
+	endpoint := "/api/datasources/" + ref
+	url := "http://" + c.user + ":" + c.password + "@" + c.GetGrafanaIP() + endpoint
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		glog.Error(err)
+	}
+	status, respBody := tryRequest(req, 3)
+	if status != "200 OK" {
+		return nil
+	}
+	var ds map[string]interface{}
+	err = json.Unmarshal(respBody, &ds)
+	if err != nil {
+		glog.Error(err)
+		return nil
+	}
+	return ds
+}
+
+// PutDataSource updates a data source of the current organization
+func (c *GrafanaClient) PutDataSource(id int, requestBody []byte, grafanaIP string) {
+	endpoint := "/api/datasources/" + strconv.Itoa(id)
+	url := "http://" + c.user + ":" + c.password + "@" + c.GetGrafanaIP() + endpoint
+	req, err := http.NewRequest("PUT", url, bytes.NewBuffer(requestBody))
+	if err != nil {
+		glog.Error(err)
+	}
+	status, respBody := tryRequest(req, 3)
+	if !reqSuccess(status, respBody) {
+		glog.Warningln("fail to put data source " + strconv.Itoa(id))
+	}
+}
+
+// lokiLabelPolicy gives the label policy of a tenant, "<tenant id>:<url encoded selector>", e.g.
+// team-a:%7Bnamespace%3D~%22team-a-dev%7Cteam-a-prod%22%7D for {namespace=~"team-a-dev|team-a-prod"}
+func lokiLabelPolicy(scopeLabel string, context TemplateContext) string {
+	var namespaces []string
+	for _, namespace := range context.Namespaces {
+		namespaces = append(namespaces, regexp.QuoteMeta(namespace))
+	}
+	selector := "{" + scopeLabel + "=~" + strconv.Quote(strings.Join(namespaces, "|")) + "}"
+	return context.TenantID + ":" + url.QueryEscape(selector)
+}
+
+// scopedByHeaders tells if the tenant of a data source is scoped by headers, which are kept in secureJsonData
+func scopedByHeaders(def DataSource) bool {
+	return len(def.Headers) > 0 || (def.Type == "loki" && def.ScopeLabel != "")
+}
+
+// tenantDataSource renders a data source definition for a tenant and applies the scoping of its type
+func tenantDataSource(def DataSource, context TemplateContext) (map[string]interface{}, error) {
+	if def.Access == "" {
+		def.Access = "proxy"
+	}
+	if def.JSONData == nil {
+		def.JSONData = make(map[string]interface{})
+	}
+	switch def.Type {
+	case "loki":
+		// grafana only sends customQueryParameters with prometheus queries, so the selector is sent as a label policy header
+		if def.ScopeLabel != "" {
+			headers := map[string]string{lokiLabelPolicyHeader: lokiLabelPolicy(def.ScopeLabel, context)}
+			for name, value := range def.Headers {
+				headers[name] = value
+			}
+			def.Headers = headers
+		}
+	case "prometheus":
+		if def.ScopeLabel != "" {
+			// the label is repeated for each namespace of a tenant grouped by label
+			var params []string
+			for _, namespace := range context.Namespaces {
+				params = append(params, url.QueryEscape(def.ScopeLabel)+"="+url.QueryEscape(namespace))
+			}
+			def.JSONData["customQueryParameters"] = strings.Join(params, "&")
+		}
+	case "elasticsearch":
+		// one index pattern per namespace
+		if def.Database == "" {
+			def.Database = "{% join .Namespaces `-*,` %}-*"
+		}
+		if def.JSONData["timeField"] == nil {
+			def.JSONData["timeField"] = "@timestamp"
+		}
+	}
+	// credentials are added after rendering, so secret values are never rendered
+	credentials, err := readCredentials(def.Credentials, context)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := credentials["basicAuthPassword"]; ok {
+		def.BasicAuth = true
+	}
+	if _, ok := credentials["tlsClientCert"]; ok {
+		def.JSONData["tlsAuth"] = true
+	}
+	if _, ok := credentials["tlsCACert"]; ok {
+		def.JSONData["tlsAuthWithCACert"] = true
+	}
+	headers := make(map[string]string)
+	for name, value := range def.Headers {
+		headers[name] = value
+	}
+	if token, ok := credentials["bearerToken"]; ok {
+		delete(credentials, "bearerToken")
+		headers["Authorization"] = "Bearer " + token
+	}
+	// headers are kept in secureJsonData, so the tenant can not read them
+	secureJSONData := make(map[string]interface{})
+	var names []string
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for i, name := range names {
+		def.JSONData["httpHeaderName"+strconv.Itoa(i+1)] = name
+		if _, ok := def.Headers[name]; ok {
+			secureJSONData["httpHeaderValue"+strconv.Itoa(i+1)] = headers[name]
+		}
+	}
+	raw, err := json.Marshal(def)
+	if err != nil {
+		return nil, err
+	}
+	var body map[string]interface{}
+	err = json.Unmarshal(raw, &body)
+	if err != nil {
+		return nil, err
+	}
+	delete(body, "scopeLabel")
+	delete(body, "headers")
+	delete(body, "credentials")
+	if len(secureJSONData) > 0 {
+		body["secureJsonData"] = secureJSONData
+	}
+	body, err = renderJSON(body, context)
+	if err != nil {
+		return nil, err
+	}
+	if len(credentials) == 0 && len(headers) == len(def.Headers) {
+		return body, nil
+	}
+	rendered, _ := body["secureJsonData"].(map[string]interface{})
+	if rendered == nil {
+		rendered = make(map[string]interface{})
+		body["secureJsonData"] = rendered
+	}
+	for field, value := range credentials {
+		rendered[field] = value
+	}
+	for i, name := range names {
+		if _, ok := def.Headers[name]; !ok {
+			rendered["httpHeaderValue"+strconv.Itoa(i+1)] = headers[name]
+		}
+	}
+	return body, nil
+}
+
+// readCredentials reads the credentials of a data source from their secrets
+func readCredentials(refs map[string]SecretRef, context TemplateContext) (map[string]string, error) {
+	credentials := make(map[string]string)
+	for field, ref := range refs {
+		if secretReader == nil {
+			return nil, errors.New("no secret reader to read credential " + field)
+		}
+		namespace, err := renderString(ref.Namespace, context)
+		if err != nil {
+			return nil, err
+		}
+		name, err := renderString(ref.Name, context)
+		if err != nil {
+			return nil, err
+		}
+		value, err := secretReader(namespace, name, ref.Key)
+		if err != nil {
+			return nil, err
+		}
+		credentials[field] = value
+	}
+	return credentials, nil
+}
+
+// DataSourceSecrets lists the secrets data source definitions read credentials from, before rendering
+func DataSourceSecrets() []SecretRef {
+	var refs []SecretRef
+	for _, def := range dataSourceDefinitions() {
+		for _, ref := range def.Credentials {
+			refs = append(refs, ref)
+		}
+	}
+	return refs
+}
+
+// TenantDataSourceSecrets lists the secrets the data sources of a tenant read credentials from, rendered for the tenant
+func TenantDataSourceSecrets(tenant Tenant) []SecretRef {
+	context := templateContext(tenant, nil)
+	var refs []SecretRef
+	for _, ref := range DataSourceSecrets() {
+		namespace, err := renderString(ref.Namespace, context)
+		if err != nil {
+			continue
+		}
+		name, err := renderString(ref.Name, context)
+		if err != nil {
+			continue
+		}
+		refs = append(refs, SecretRef{Namespace: namespace, Name: name, Key: ref.Key})
+	}
+	return refs
+}
+
+// dataSourceDefinitions reads DATASOURCES, a json list of DataSource. The default is a prometheus data source at the prometheus service or PROMETHEUS_IP.
+func dataSourceDefinitions() []DataSource {
+	defs := os.Getenv("DATASOURCES")
+	if defs == "" {
+		return []DataSource{{
+			Name:   "prometheus",
+			Type:   "prometheus",
+			URL:    "http://" + prometheusAddress(),
+			Access: "proxy",
+		}}
+	}
+	var list []DataSource
+	err := json.Unmarshal([]byte(defs), &list)
+	if err != nil {
+		glog.Errorln("invalid DATASOURCES: " + err.Error())
+		return nil
+	}
+	return list
+}
@@ -0,0 +1,64 @@
+package grafana
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestTenantDataSourceScope(t *testing.T) {
+	context := TemplateContext{Namespace: "team-a", Namespaces: []string{"team-a-dev", "team-a-prod"}, TenantID: "team-a"}
+	tests := []struct {
+		name           string
+		def            DataSource
+		wantParameters string
+		wantHeaders    map[string]string
+	}{
+		{
+			"prometheus",
+			DataSource{Name: "prometheus", Type: "prometheus", URL: "http://proxy:8080", ScopeLabel: "namespace"},
+			"namespace=team-a-dev&namespace=team-a-prod",
+			nil,
+		},
+		{
+			"loki",
+			DataSource{Name: "loki", Type: "loki", URL: "http://gateway:3100", ScopeLabel: "namespace"},
+			"",
+			map[string]string{"X-Prom-Label-Policy": "team-a:%7Bnamespace%3D~%22team-a-dev%7Cteam-a-prod%22%7D"},
+		},
+		{
+			"loki with headers",
+			DataSource{Name: "loki", Type: "loki", URL: "http://gateway:3100", ScopeLabel: "namespace", Headers: map[string]string{"X-Scope-OrgID": "{% .TenantID %}"}},
+			"",
+			map[string]string{"X-Prom-Label-Policy": "team-a:%7Bnamespace%3D~%22team-a-dev%7Cteam-a-prod%22%7D", "X-Scope-OrgID": "team-a"},
+		},
+	}
+	for _, test := range tests {
+		body, err := tenantDataSource(test.def, context)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		jsonData, _ := body["jsonData"].(map[string]interface{})
+		if parameters, _ := jsonData["customQueryParameters"].(string); parameters != test.wantParameters {
+			t.Errorf("%s: got parameters %q, want %q", test.name, parameters, test.wantParameters)
+		}
+		secureJSONData, _ := body["secureJsonData"].(map[string]interface{})
+		headers := make(map[string]string)
+		for i := 1; ; i++ {
+			name, ok := jsonData["httpHeaderName"+strconv.Itoa(i)].(string)
+			if !ok {
+				break
+			}
+			headers[name], _ = secureJSONData["httpHeaderValue"+strconv.Itoa(i)].(string)
+		}
+		if len(headers) != len(test.wantHeaders) {
+			t.Errorf("%s: got headers %v, want %v", test.name, headers, test.wantHeaders)
+			continue
+		}
+		for name, want := range test.wantHeaders {
+			if headers[name] != want {
+				t.Errorf("%s: got header %s %q, want %q", test.name, name, headers[name], want)
+			}
+		}
+	}
+}
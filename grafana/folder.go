@@ -0,0 +1,138 @@
+package grafana
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"os"
+
+	"github.com/golang/glog"
+)
+
+// ensureFolder makes sure the folder of a template dashboard exists in the current organization and returns its id.
+// If DASHBOARD_FOLDER is set, all tenant dashboards go to that folder. Otherwise the folder of the template is mirrored
+// with the same uid, and renamed when the template folder is renamed. 0 means the General folder.
+func (c *GrafanaClient) ensureFolder(db Dashboard) int {
+	if name := dashboardFolder(); name != "" {
+		return c.ensureFolderByTitle(name)
+	}
+	if db.FolderTitle == "" {
+		return 0
+	}
+	if db.FolderUID == "" {
+		return c.ensureFolderByTitle(db.FolderTitle)
+	}
+	folder := c.GetFolderByUID(db.FolderUID, c.GetGrafanaIP())
+	if folder == nil {
+		return folderID(c.PostFolder(db.FolderUID, db.FolderTitle, c.GetGrafanaIP()))
+	}
+	if folder["title"] != db.FolderTitle {
+		c.PutFolder(db.FolderUID, db.FolderTitle, c.GetGrafanaIP())
+	}
+	return folderID(folder)
+}
+
+// ensureFolderByTitle returns the id of the folder with the given title in the current organization, creating it if needed
+func (c *GrafanaClient) ensureFolderByTitle(title string) int {
+	for _, folder := range c.GetFolders(c.GetGrafanaIP()) {
+		if folder["title"] == title {
+			return folderID(folder)
+		}
+	}
+	return folderID(c.PostFolder("", title, c.GetGrafanaIP()))
+}
+
+// GetFolders gets all the folders in the current organization
+func (c *GrafanaClient) GetFolders(grafanaIP string) []map[string]interface{} {
+	endpoint := "/api/folders"
+	url := "http://" + c.user + ":" + c.password + "@" + c.GetGrafanaIP() + endpoint
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		glog.Error(err)
+	}
+	status, respBody := tryRequest(req, 3)
+	if !reqSuccess(status, respBody) {
+		glog.Warningln("fail to get folders")
+		return nil
+	}
+	var folders []map[string]interface{}
+	err = json.Unmarshal(respBody, &folders)
+	if err != nil {
+		glog.Error(err)
+		return nil
+	}
+	return folders
+}
+
+// GetFolderByUID gets a folder in the current organization. It returns nil if the folder does not exist.
+func (c *GrafanaClient) GetFolderByUID(uid string, grafanaIP string) map[string]interface{} {
+	endpoint := "/api/folders/" + uid
+	url := "http://" + c.user + ":" + c.password + "@" + c.GetGrafanaIP() + endpoint
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		glog.Error(err)
+	}
+	status, respBody := tryRequest(req, 3)
+	if status != "200 OK" {
+		return nil
+	}
+	var folder map[string]interface{}
+	err = json.Unmarshal(respBody, &folder)
+	if err != nil {
+		glog.Error(err)
+		return nil
+	}
+	return folder
+}
+
+// PostFolder creates a folder in the current organization. If uid is empty, grafana generates one.
+func (c *GrafanaClient) PostFolder(uid string, title string, grafanaIP string) map[string]interface{} {
+	endpoint := "/api/folders"
+	body := map[string]string{"title": title}
+	if uid != "" {
+		body["uid"] = uid
+	}
+	requestBody, _ := json.Marshal(body)
+	url := "http://" + c.user + ":" + c.password + "@" + c.GetGrafanaIP() + endpoint
+	req, err := http.NewRequest("POST", url, bytes.NewBuffer(requestBody))
+	if err != nil {
+		glog.Error(err)
+	}
+	status, respBody := tryRequest(req, 3)
+	if !reqSuccess(status, respBody) {
+		glog.Warningln("fail to post folder " + title)
+		return nil
+	}
+	var folder map[string]interface{}
+	err = json.Unmarshal(respBody, &folder)
+	if err != nil {
+		glog.Error(err)
+		return nil
+	}
+	return folder
+}
+
+// PutFolder renames a folder in the current organization
+func (c *GrafanaClient) PutFolder(uid string, title string, grafanaIP string) {
+	endpoint := "/api/folders/" + uid
+	requestBody, _ := json.Marshal(map[string]interface{}{"title": title, "overwrite": true})
+	url := "http://" + c.user + ":" + c.password + "@" + c.GetGrafanaIP() + endpoint
+	req, err := http.NewRequest("PUT", url, bytes.NewBuffer(requestBody))
+	if err != nil {
+		glog.Error(err)
+	}
+	status, respBody := tryRequest(req, 3)
+	if !reqSuccess(status, respBody) {
+		glog.Warningln("fail to put folder " + title)
+	}
+}
+
+func folderID(folder map[string]interface{}) int {
+	id, _ := folder["id"].(float64)
+	return int(id)
+}
+
+func dashboardFolder() string {
+	name := os.Getenv("DASHBOARD_FOLDER")
+	return name
+}
@@ -0,0 +1,64 @@
+package grafana
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/golang/glog"
+)
+
+// DataSourceHealth is the result of the health check of a data source
+type DataSourceHealth struct {
+	Status  string `json:"status"`
+	Message string `json:"message,omitempty"`
+}
+
+// CheckTenantDataSources runs the grafana health check of every data source of DATASOURCES in the organization of a tenant.
+// It returns the results by rendered data source name, or nil if the organization does not exist.
+func (c *GrafanaClient) CheckTenantDataSources(tenant Tenant) map[string]DataSourceHealth {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	orgID := c.GetOrgID(tenant.Name, c.GetGrafanaIP())
+	if orgID == 0 {
+		return nil
+	}
+	c.SwitchOrg(orgID, c.GetGrafanaIP())
+	context := templateContext(tenant, nil)
+	results := make(map[string]DataSourceHealth)
+	for _, def := range dataSourceDefinitions() {
+		body, err := tenantDataSource(def, context)
+		if err != nil {
+			results[def.Name] = DataSourceHealth{Status: "ERROR", Message: "fail to render data source: " + err.Error()}
+			continue
+		}
+		name, _ := body["name"].(string)
+		ds := c.getRenderedDataSource(body)
+		if ds == nil {
+			results[name] = DataSourceHealth{Status: "ERROR", Message: "data source not found"}
+			continue
+		}
+		uid, _ := ds["uid"].(string)
+		results[name] = c.GetDataSourceHealth(uid, c.GetGrafanaIP())
+	}
+	return results
+}
+
+// GetDataSourceHealth runs the health check of a data source in the current organization
+func (c *GrafanaClient) GetDataSourceHealth(uid string, grafanaIP string) DataSourceHealth {
+	endpoint := "/api/datasources/uid/" + uid + "/health"
+	url := "http://" + c.user + ":" + c.password + "@" + c.GetGrafanaIP() + endpoint
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		glog.Error(err)
+	}
+	status, respBody := tryRequest(req, 3)
+	var health DataSourceHealth
+	err = json.Unmarshal(respBody, &health)
+	if err != nil || health.Status == "" {
+		health = DataSourceHealth{Status: "ERROR", Message: status + " " + string(respBody)}
+	}
+	if status != "200 OK" && health.Status == "OK" {
+		health.Status = "ERROR"
+	}
+	return health
+}
@@ -0,0 +1,140 @@
+package grafana
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"reflect"
+
+	"github.com/golang/glog"
+)
+
+// libraryPanelUIDs lists the uids of the library panels a dashboard uses
+func libraryPanelUIDs(dashboard map[string]interface{}) []string {
+	var uids []string
+	seen := make(map[string]bool)
+	for _, panel := range dashboardPanels(dashboard) {
+		libraryPanel, _ := panel["libraryPanel"].(map[string]interface{})
+		uid, _ := libraryPanel["uid"].(string)
+		if uid != "" && !seen[uid] {
+			seen[uid] = true
+			uids = append(uids, uid)
+		}
+	}
+	return uids
+}
+
+// ensureLibraryPanels copies the library panels of a dashboard into the current organization with the same uid, and updates
+// the copies whose model changed. Models of dashboards tagged tenant-template are rendered with context if it is not nil.
+// Models have no variables of their own, so their queries are scoped by the Namespace variable of the dashboard using them.
+func (c *GrafanaClient) ensureLibraryPanels(db Dashboard, folderID int, context *TemplateContext) {
+	for _, element := range db.LibraryPanels {
+		uid, _ := element["uid"].(string)
+		model, _ := element["model"].(map[string]interface{})
+		if uid == "" || model == nil {
+			continue
+		}
+		if context != nil && isTemplate(db.Model) {
+			rendered, err := renderJSON(model, *context)
+			if err != nil {
+				glog.Warningln("fail to render library panel " + uid + ": " + err.Error())
+				continue
+			}
+			model = rendered
+		}
+		body := map[string]interface{}{
+			"uid":      uid,
+			"name":     element["name"],
+			"kind":     element["kind"],
+			"model":    model,
+			"folderId": folderID,
+		}
+		existing := c.GetLibraryElement(uid, c.GetGrafanaIP())
+		if existing == nil {
+			c.PostLibraryElement(body, c.GetGrafanaIP())
+			continue
+		}
+		if !libraryPanelChanged(existing, model) && existing["name"] == element["name"] {
+			continue
+		}
+		body["version"] = existing["version"]
+		c.PatchLibraryElement(uid, body, c.GetGrafanaIP())
+	}
+}
+
+// libraryPanelChanged tells if the model of an existing library element differs from the desired model. Grafana adds
+// keys such as libraryPanel and id to the models it returns, so only the keys of the desired model are compared, in
+// their json form.
+func libraryPanelChanged(existing map[string]interface{}, desired map[string]interface{}) bool {
+	model, _ := existing["model"].(map[string]interface{})
+	raw, err := json.Marshal(desired)
+	if err != nil {
+		return true
+	}
+	var normalized map[string]interface{}
+	if err = json.Unmarshal(raw, &normalized); err != nil {
+		return true
+	}
+	for key, want := range normalized {
+		if key == "id" || key == "libraryPanel" || key == "gridPos" {
+			continue
+		}
+		if !reflect.DeepEqual(model[key], want) {
+			return true
+		}
+	}
+	return false
+}
+
+// GetLibraryElement gets a library element of the current organization. It returns nil if the element does not exist.
+func (c *GrafanaClient) GetLibraryElement(uid string, grafanaIP string) map[string]interface{} {
+	endpoint := "/api/library-elements/" + uid
+	url := "http://" + c.user + ":" + c.password + "@" + c.GetGrafanaIP() + endpoint
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		glog.Error(err)
+	}
+	status, respBody := tryRequest(req, 3)
+	if status != "200 OK" {
+		return nil
+	}
+	var result struct {
+		Result map[string]interface{} `json:"result"`
+	}
+	err = json.Unmarshal(respBody, &result)
+	if err != nil {
+		glog.Error(err)
+		return nil
+	}
+	return result.Result
+}
+
+// PostLibraryElement creates a library element in the current organization
+func (c *GrafanaClient) PostLibraryElement(element map[string]interface{}, grafanaIP string) {
+	endpoint := "/api/library-elements"
+	requestBody, _ := json.Marshal(element)
+	url := "http://" + c.user + ":" + c.password + "@" + c.GetGrafanaIP() + endpoint
+	req, err := http.NewRequest("POST", url, bytes.NewBuffer(requestBody))
+	if err != nil {
+		glog.Error(err)
+	}
+	status, respBody := tryRequest(req, 3)
+	if !reqSuccess(status, respBody) {
+		glog.Warningf("fail to post library element %v", element["uid"])
+	}
+}
+
+// PatchLibraryElement updates a library element in the current organization. element must have the version of the existing element.
+func (c *GrafanaClient) PatchLibraryElement(uid string, element map[string]interface{}, grafanaIP string) {
+	endpoint := "/api/library-elements/" + uid
+	requestBody, _ := json.Marshal(element)
+	url := "http://" + c.user + ":" + c.password + "@" + c.GetGrafanaIP() + endpoint
+	req, err := http.NewRequest("PATCH", url, bytes.NewBuffer(requestBody))
+	if err != nil {
+		glog.Error(err)
+	}
+	status, respBody := tryRequest(req, 3)
+	if !reqSuccess(status, respBody) {
+		glog.Warningln("fail to patch library element " + uid)
+	}
+}
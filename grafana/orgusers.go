@@ -0,0 +1,132 @@
+package grafana
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/golang/glog"
+)
+
+// roleRank orders org roles, so the highest role wins when a user is granted several
+var roleRank = map[string]int{"Viewer": 1, "Editor": 2, "Admin": 3}
+
+// HigherRole gives the higher of two org roles
+func HigherRole(a string, b string) string {
+	if roleRank[b] > roleRank[a] {
+		return b
+	}
+	return a
+}
+
+// SyncOrgUsers gives users the org roles in desired, by login, in the organization of a tenant. Users that do not exist are
+// created with a random password. Users in previous but not in desired are removed from the organization.
+func (c *GrafanaClient) SyncOrgUsers(namespace string, desired map[string]string, previous []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	orgID := c.GetOrgID(namespace, c.GetGrafanaIP())
+	if orgID == 0 {
+		return
+	}
+	c.syncOrgUsers(orgID, desired, previous)
+	glog.Flush()
+}
+
+// syncOrgUsers gives users the org roles in desired in an organization, and removes users in previous but not in desired
+func (c *GrafanaClient) syncOrgUsers(orgID int, desired map[string]string, previous []string) {
+	members := c.GetOrgUsers(orgID, c.GetGrafanaIP())
+	for login, role := range desired {
+		member, ok := members[login]
+		if !ok {
+			if c.GetUserID(login, c.GetGrafanaIP()) == 0 {
+				c.PostUserWithPassword(login, randomPassword(), c.GetGrafanaIP())
+			}
+			c.PostUserToOrg(login, orgID, c.GetGrafanaIP(), role)
+			continue
+		}
+		if member["role"] != role {
+			userID, _ := member["userId"].(float64)
+			c.PatchOrgUserRole(int(userID), orgID, role, c.GetGrafanaIP())
+		}
+	}
+	for _, login := range previous {
+		if _, ok := desired[login]; ok {
+			continue
+		}
+		if member, ok := members[login]; ok {
+			userID, _ := member["userId"].(float64)
+			c.DeleteUserInOrg(int(userID), orgID, c.GetGrafanaIP())
+		}
+	}
+}
+
+// GetOrgUsers gets the users of an organization by login
+func (c *GrafanaClient) GetOrgUsers(orgID int, grafanaIP string) map[string]map[string]interface{} {
+	endpoint := "/api/orgs/" + strconv.Itoa(orgID) + "/users"
+	url := "http://" + c.user + ":" + c.password + "@" + c.GetGrafanaIP() + endpoint
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		glog.Error(err)
+	}
+	status, respBody := tryRequest(req, 3)
+	if !reqSuccess(status, respBody) {
+		glog.Warningln("fail to get org users")
+		return nil
+	}
+	var list []map[string]interface{}
+	err = json.Unmarshal(respBody, &list)
+	if err != nil {
+		glog.Error(err)
+		return nil
+	}
+	users := make(map[string]map[string]interface{})
+	for _, user := range list {
+		if login, ok := user["login"].(string); ok {
+			users[login] = user
+		}
+	}
+	return users
+}
+
+// PatchOrgUserRole changes the role of a user in an organization
+func (c *GrafanaClient) PatchOrgUserRole(userID int, orgID int, role string, grafanaIP string) {
+	endpoint := "/api/orgs/" + strconv.Itoa(orgID) + "/users/" + strconv.Itoa(userID)
+	var requestBody = []byte(`{"role":"` + role + `"}`)
+	url := "http://" + c.user + ":" + c.password + "@" + c.GetGrafanaIP() + endpoint
+	req, err := http.NewRequest("PATCH", url, bytes.NewBuffer(requestBody))
+	if err != nil {
+		glog.Error(err)
+	}
+	status, respBody := tryRequest(req, 3)
+	if !reqSuccess(status, respBody) {
+		glog.Warningln("fail to patch org user role")
+	}
+}
+
+// PostUserWithPassword adds a new user with the given password
+func (c *GrafanaClient) PostUserWithPassword(name string, password string, grafanaIP string) {
+	endpoint := "/api/admin/users"
+	requestBody, _ := json.Marshal(map[string]string{"name": name, "login": name, "password": password})
+	url := "http://" + c.user + ":" + c.password + "@" + c.GetGrafanaIP() + endpoint
+	req, err := http.NewRequest("POST", url, bytes.NewBuffer(requestBody))
+	if err != nil {
+		glog.Error(err)
+	}
+	status, respBody := tryRequest(req, 3)
+	if !reqSuccess(status, respBody) {
+		glog.Warningln("fail to add user " + name)
+	}
+}
+
+// randomPassword gives users created for kubernetes subjects a password nobody knows. They log in through external authentication or after a password reset.
+func randomPassword() string {
+	b := make([]byte, 24)
+	_, err := rand.Read(b)
+	if err != nil {
+		glog.Error(err)
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,53 @@
+package grafana
+
+import (
+	"errors"
+
+	"github.com/golang/glog"
+)
+
+// viewerPassword is the password PostUser gives to tenant viewers
+const viewerPassword = "password"
+
+// viewerPasswordReader reads the current password of the viewer of a tenant from a namespace of the tenant. It gives an
+// empty password if the namespace has none.
+var viewerPasswordReader func(namespace string) (string, error)
+
+// SetViewerPasswordReader sets how the current password of a tenant viewer is read, once viewer passwords are rotated
+func SetViewerPasswordReader(reader func(namespace string) (string, error)) {
+	viewerPasswordReader = reader
+}
+
+// viewerPasswordOf gives the current password of the viewer of a tenant from the first of its namespaces that has one,
+// or the password of PostUser if it was never rotated. It fails if a password can not be read.
+func viewerPasswordOf(tenant Tenant) (string, error) {
+	if viewerPasswordReader == nil {
+		return viewerPassword, nil
+	}
+	for _, namespace := range tenant.NamespaceList() {
+		password, err := viewerPasswordReader(namespace)
+		if err != nil {
+			return "", err
+		}
+		if password != "" {
+			return password, nil
+		}
+	}
+	return viewerPassword, nil
+}
+
+// RotateViewerPassword sets a new password for the viewer of a tenant organization and returns it
+func (c *GrafanaClient) RotateViewerPassword(org string) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	userID := c.GetUserID(org, c.GetGrafanaIP())
+	if userID == 0 {
+		return "", errors.New("viewer " + org + " not found")
+	}
+	password := randomPassword()
+	if !c.PutUserPassword(userID, c.GetGrafanaIP(), password) {
+		return "", errors.New("fail to put password of viewer " + org)
+	}
+	glog.Flush()
+	return password, nil
+}
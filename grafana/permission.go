@@ -0,0 +1,156 @@
+package grafana
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"os"
+
+	"github.com/golang/glog"
+)
+
+// folderPermissionsAnnotation of a namespace overrides FOLDER_PERMISSIONS for the folders it lists
+const folderPermissionsAnnotation = "grafana-controller/folder-permissions"
+
+// FolderPermission grants a role, a team or a user View, Edit or Admin permission on a folder
+type FolderPermission struct {
+	Role       string `json:"role,omitempty"`
+	Team       string `json:"team,omitempty"`
+	User       string `json:"user,omitempty"`
+	Permission string `json:"permission"`
+}
+
+var permissionLevels = map[string]int{"View": 1, "Edit": 2, "Admin": 4}
+
+// putFolderPermissions replaces the permissions of the folders configured for a tenant in the current organization.
+// Roles, teams and users that are not listed lose access to the folder. Folders that do not exist are skipped, and so
+// are folders with an unknown permission or a team or user that can not be looked up.
+func (c *GrafanaClient) putFolderPermissions(tenant Tenant) {
+	permissions := folderPermissions(tenant)
+	if len(permissions) == 0 {
+		return
+	}
+	folders := make(map[string]string)
+	for _, folder := range c.GetFolders(c.GetGrafanaIP()) {
+		title, _ := folder["title"].(string)
+		uid, _ := folder["uid"].(string)
+		folders[title] = uid
+	}
+	for title, list := range permissions {
+		uid, ok := folders[title]
+		if !ok {
+			continue
+		}
+		var items []map[string]interface{}
+		// a grant that can not be written would be dropped, so the folder is left as it is
+		complete := true
+		for _, p := range list {
+			level, ok := permissionLevels[p.Permission]
+			if !ok {
+				glog.Warningln("unknown permission " + p.Permission + " for folder " + title + " in org " + tenant.Name)
+				complete = false
+				continue
+			}
+			item := map[string]interface{}{"permission": level}
+			switch {
+			case p.Role != "":
+				item["role"] = p.Role
+			case p.Team != "":
+				teamID := c.GetTeamID(p.Team, c.GetGrafanaIP())
+				if teamID == 0 {
+					complete = false
+					continue
+				}
+				item["teamId"] = teamID
+			case p.User != "":
+				userID := c.GetUserID(p.User, c.GetGrafanaIP())
+				if userID == 0 {
+					complete = false
+					continue
+				}
+				item["userId"] = userID
+			default:
+				continue
+			}
+			items = append(items, item)
+		}
+		if !complete {
+			glog.Warningln("fail to resolve a permission of folder " + title + " in org " + tenant.Name + ", permissions are not changed")
+			continue
+		}
+		c.PostFolderPermissions(uid, items, c.GetGrafanaIP())
+	}
+}
+
+// PostFolderPermissions replaces all the permissions of a folder in the current organization
+func (c *GrafanaClient) PostFolderPermissions(uid string, items []map[string]interface{}, grafanaIP string) {
+	endpoint := "/api/folders/" + uid + "/permissions"
+	if items == nil {
+		items = []map[string]interface{}{}
+	}
+	requestBody, _ := json.Marshal(map[string]interface{}{"items": items})
+	url := "http://" + c.user + ":" + c.password + "@" + c.GetGrafanaIP() + endpoint
+	req, err := http.NewRequest("POST", url, bytes.NewBuffer(requestBody))
+	if err != nil {
+		glog.Error(err)
+	}
+	status, respBody := tryRequest(req, 3)
+	if !reqSuccess(status, respBody) {
+		glog.Warningln("fail to post permissions of folder " + uid)
+	}
+}
+
+// GetTeamID gets the id of a team in the current organization. It returns 0 if the team does not exist.
+func (c *GrafanaClient) GetTeamID(name string, grafanaIP string) int {
+	endpoint := "/api/teams/search?name=" + url.QueryEscape(name)
+	url := "http://" + c.user + ":" + c.password + "@" + c.GetGrafanaIP() + endpoint
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		glog.Error(err)
+	}
+	status, respBody := tryRequest(req, 3)
+	if !reqSuccess(status, respBody) {
+		glog.Warningln("fail to get team id")
+		return 0
+	}
+	var result struct {
+		Teams []struct {
+			ID   int    `json:"id"`
+			Name string `json:"name"`
+		} `json:"teams"`
+	}
+	err = json.Unmarshal(respBody, &result)
+	if err != nil {
+		glog.Error(err)
+		return 0
+	}
+	for _, team := range result.Teams {
+		if team.Name == name {
+			return team.ID
+		}
+	}
+	glog.Warningln("team " + name + " not found")
+	return 0
+}
+
+// folderPermissions reads the permissions by folder title from FOLDER_PERMISSIONS and the folder-permissions annotation of the namespace.
+// Both are json like {"ops": [{"role": "Editor", "permission": "Edit"}, {"team": "sre", "permission": "Admin"}]}.
+func folderPermissions(tenant Tenant) map[string][]FolderPermission {
+	permissions := make(map[string][]FolderPermission)
+	for _, source := range []string{os.Getenv("FOLDER_PERMISSIONS"), tenant.Annotations[folderPermissionsAnnotation]} {
+		if source == "" {
+			continue
+		}
+		var m map[string][]FolderPermission
+		err := json.Unmarshal([]byte(source), &m)
+		if err != nil {
+			glog.Warningln("invalid folder permissions for org " + tenant.Name + ": " + err.Error())
+			continue
+		}
+		for title, list := range m {
+			permissions[title] = list
+		}
+	}
+	return permissions
+}
@@ -0,0 +1,107 @@
+package grafana
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"os"
+
+	"github.com/golang/glog"
+)
+
+// annotations of a namespace that override the default preferences of its organization
+const (
+	homeDashboardAnnotation = "grafana-controller/home-dashboard"
+	themeAnnotation         = "grafana-controller/theme"
+	timezoneAnnotation      = "grafana-controller/timezone"
+	weekStartAnnotation     = "grafana-controller/week-start"
+)
+
+// putPreferences sets the home dashboard, theme, timezone and week start of the current organization and of its viewer
+func (c *GrafanaClient) putPreferences(tenant Tenant) {
+	preferences := make(map[string]interface{})
+	if theme := preference(tenant, themeAnnotation, "THEME"); theme != "" {
+		preferences["theme"] = theme
+	}
+	if timezone := preference(tenant, timezoneAnnotation, "TIMEZONE"); timezone != "" {
+		preferences["timezone"] = timezone
+	}
+	if weekStart := preference(tenant, weekStartAnnotation, "WEEK_START"); weekStart != "" {
+		preferences["weekStart"] = weekStart
+	}
+	home := preference(tenant, homeDashboardAnnotation, "HOME_DASHBOARD")
+	if home == "" {
+		home = "Pods"
+	}
+	if dashboard := c.GetDashboardByTitle(home, c.GetGrafanaIP()); dashboard != nil {
+		preferences["homeDashboardId"] = dashboard["id"]
+		preferences["homeDashboardUID"] = dashboard["uid"]
+	} else {
+		glog.Warningln("home dashboard " + home + " not found in org " + tenant.Name)
+	}
+	if len(preferences) == 0 {
+		return
+	}
+	requestBody, _ := json.Marshal(preferences)
+	c.PutPreferences("/api/org/preferences", requestBody, c.GetGrafanaIP())
+	password, err := viewerPasswordOf(tenant)
+	if err != nil {
+		glog.Warningln("fail to read viewer password of org " + tenant.Name + ", viewer preferences are not set: " + err.Error())
+		return
+	}
+	viewer, err := NewGrafanaClient(c.GetGrafanaIP(), tenant.Name, password)
+	if err != nil {
+		glog.Error(err)
+		return
+	}
+	viewer.PutPreferences("/api/user/preferences", requestBody, c.GetGrafanaIP())
+}
+
+// GetDashboardByTitle finds a dashboard in the current organization by its title. It returns the search result, or nil if there is none.
+func (c *GrafanaClient) GetDashboardByTitle(title string, grafanaIP string) map[string]interface{} {
+	endpoint := "/api/search?type=dash-db&query=" + url.QueryEscape(title)
+	url := "http://" + c.user + ":" + c.password + "@" + c.GetGrafanaIP() + endpoint
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		glog.Error(err)
+	}
+	status, respBody := tryRequest(req, 3)
+	if !reqSuccess(status, respBody) {
+		glog.Warningln("fail to search dashboard " + title)
+		return nil
+	}
+	var result []map[string]interface{}
+	err = json.Unmarshal(respBody, &result)
+	if err != nil {
+		glog.Error(err)
+		return nil
+	}
+	for _, d := range result {
+		if d["title"] == title {
+			return d
+		}
+	}
+	return nil
+}
+
+// PutPreferences updates the preferences of the current organization with endpoint /api/org/preferences, or of the client user with /api/user/preferences
+func (c *GrafanaClient) PutPreferences(endpoint string, requestBody []byte, grafanaIP string) {
+	url := "http://" + c.user + ":" + c.password + "@" + c.GetGrafanaIP() + endpoint
+	req, err := http.NewRequest("PUT", url, bytes.NewBuffer(requestBody))
+	if err != nil {
+		glog.Error(err)
+	}
+	status, respBody := tryRequest(req, 3)
+	if !reqSuccess(status, respBody) {
+		glog.Warningln("fail to put preferences " + endpoint)
+	}
+}
+
+// preference reads a preference from a namespace annotation, or else from an environment variable
+func preference(tenant Tenant, annotation string, env string) string {
+	if value := tenant.Annotations[annotation]; value != "" {
+		return value
+	}
+	return os.Getenv(env)
+}
@@ -0,0 +1,103 @@
+package grafana
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/golang/glog"
+)
+
+// quotaSettings gives the namespace annotation and the environment variable of the limit of each org quota target
+var quotaSettings = map[string][2]string{
+	"dashboard":   {"grafana-controller/quota-dashboards", "QUOTA_DASHBOARDS"},
+	"data_source": {"grafana-controller/quota-datasources", "QUOTA_DATASOURCES"},
+	"user":        {"grafana-controller/quota-users", "QUOTA_USERS"},
+	"api_key":     {"grafana-controller/quota-api-keys", "QUOTA_API_KEYS"},
+}
+
+// Quota is the limit and usage of an org quota target. A limit of -1 is unlimited.
+type Quota struct {
+	Limit int64 `json:"limit"`
+	Used  int64 `json:"used"`
+}
+
+// putQuotas sets the quotas of an organization configured for its tenant. Targets without a limit are reset to
+// unlimited, so removing a limit from the annotation or environment takes effect.
+func (c *GrafanaClient) putQuotas(tenant Tenant, orgID int) {
+	current := c.GetOrgQuotas(orgID, c.GetGrafanaIP())
+	if current == nil {
+		return
+	}
+	for target, setting := range quotaSettings {
+		value := preference(tenant, setting[0], setting[1])
+		if value == "" {
+			value = "-1"
+		}
+		limit, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			glog.Warningln("invalid " + target + " quota " + value + " for org " + tenant.Name)
+			continue
+		}
+		if quota, ok := current[target]; ok && quota.Limit == limit {
+			continue
+		}
+		c.PutOrgQuota(orgID, target, limit, c.GetGrafanaIP())
+	}
+}
+
+// GetTenantQuotas gets the quotas of the organization of a tenant by target. It returns nil if the organization does not exist.
+func (c *GrafanaClient) GetTenantQuotas(org string) map[string]Quota {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	orgID := c.GetOrgID(org, c.GetGrafanaIP())
+	if orgID == 0 {
+		return nil
+	}
+	return c.GetOrgQuotas(orgID, c.GetGrafanaIP())
+}
+
+// GetOrgQuotas gets the quotas of an organization by target
+func (c *GrafanaClient) GetOrgQuotas(orgID int, grafanaIP string) map[string]Quota {
+	endpoint := "/api/orgs/" + strconv.Itoa(orgID) + "/quotas"
+	url := "http://" + c.user + ":" + c.password + "@" + c.GetGrafanaIP() + endpoint
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		glog.Error(err)
+	}
+	status, respBody := tryRequest(req, 3)
+	if !reqSuccess(status, respBody) {
+		glog.Warningln("fail to get org quotas")
+		return nil
+	}
+	var list []struct {
+		Target string `json:"target"`
+		Quota
+	}
+	err = json.Unmarshal(respBody, &list)
+	if err != nil {
+		glog.Error(err)
+		return nil
+	}
+	quotas := make(map[string]Quota)
+	for _, q := range list {
+		quotas[q.Target] = q.Quota
+	}
+	return quotas
+}
+
+// PutOrgQuota sets the limit of a quota target of an organization
+func (c *GrafanaClient) PutOrgQuota(orgID int, target string, limit int64, grafanaIP string) {
+	endpoint := "/api/orgs/" + strconv.Itoa(orgID) + "/quotas/" + target
+	var requestBody = []byte(`{"limit":` + strconv.FormatInt(limit, 10) + `}`)
+	url := "http://" + c.user + ":" + c.password + "@" + c.GetGrafanaIP() + endpoint
+	req, err := http.NewRequest("PUT", url, bytes.NewBuffer(requestBody))
+	if err != nil {
+		glog.Error(err)
+	}
+	status, respBody := tryRequest(req, 3)
+	if !reqSuccess(status, respBody) {
+		glog.Warningln("fail to put " + target + " quota of org " + strconv.Itoa(orgID))
+	}
+}
@@ -0,0 +1,165 @@
+package grafana
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/golang/glog"
+)
+
+// IssueTenantToken creates a service account with a role in the organization of a tenant and returns a new API token of it.
+// An existing service account with the same name is replaced, which revokes its tokens.
+func (c *GrafanaClient) IssueTenantToken(org string, name string, role string) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := roleRank[role]; !ok {
+		return "", errors.New("unknown role " + role)
+	}
+	orgID := c.GetOrgID(org, c.GetGrafanaIP())
+	if orgID == 0 {
+		return "", errors.New("org " + org + " not found")
+	}
+	c.SwitchOrg(orgID, c.GetGrafanaIP())
+	if id := c.GetServiceAccountID(name, c.GetGrafanaIP()); id != 0 {
+		c.DeleteServiceAccount(id, c.GetGrafanaIP())
+	}
+	id := c.PostServiceAccount(name, role, c.GetGrafanaIP())
+	if id == 0 {
+		return "", errors.New("fail to create service account " + name + " in org " + org)
+	}
+	token := c.PostServiceAccountToken(id, name, c.GetGrafanaIP())
+	if token == "" {
+		return "", errors.New("fail to create token of service account " + name + " in org " + org)
+	}
+	glog.Flush()
+	return token, nil
+}
+
+// RevokeTenantToken deletes a service account in the organization of a tenant with all its tokens
+func (c *GrafanaClient) RevokeTenantToken(org string, name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	orgID := c.GetOrgID(org, c.GetGrafanaIP())
+	if orgID == 0 {
+		return
+	}
+	c.SwitchOrg(orgID, c.GetGrafanaIP())
+	if id := c.GetServiceAccountID(name, c.GetGrafanaIP()); id != 0 {
+		c.DeleteServiceAccount(id, c.GetGrafanaIP())
+	}
+	glog.Flush()
+}
+
+// TenantTokenExists tells if a service account exists in the organization of a tenant, which is not the case if the
+// organization does not exist. It fails if the service accounts can not be searched.
+func (c *GrafanaClient) TenantTokenExists(org string, name string) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	orgID := c.GetOrgID(org, c.GetGrafanaIP())
+	if orgID == 0 {
+		return false, nil
+	}
+	c.SwitchOrg(orgID, c.GetGrafanaIP())
+	id, err := c.searchServiceAccount(name)
+	return id != 0, err
+}
+
+// GetServiceAccountID gets the id of a service account in the current organization. It returns 0 if there is none.
+func (c *GrafanaClient) GetServiceAccountID(name string, grafanaIP string) int {
+	id, err := c.searchServiceAccount(name)
+	if err != nil {
+		glog.Warningln(err)
+	}
+	return id
+}
+
+// searchServiceAccount gets the id of a service account in the current organization, or 0 if there is none
+func (c *GrafanaClient) searchServiceAccount(name string) (int, error) {
+	endpoint := "/api/serviceaccounts/search?query=" + url.QueryEscape(name)
+	url := "http://" + c.user + ":" + c.password + "@" + c.GetGrafanaIP() + endpoint
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		glog.Error(err)
+	}
+	status, respBody := tryRequest(req, 3)
+	if !reqSuccess(status, respBody) {
+		return 0, errors.New("fail to search service account " + name)
+	}
+	var result struct {
+		ServiceAccounts []struct {
+			ID   int    `json:"id"`
+			Name string `json:"name"`
+		} `json:"serviceAccounts"`
+	}
+	err = json.Unmarshal(respBody, &result)
+	if err != nil {
+		return 0, err
+	}
+	for _, sa := range result.ServiceAccounts {
+		if sa.Name == name {
+			return sa.ID, nil
+		}
+	}
+	return 0, nil
+}
+
+// PostServiceAccount adds a service account with an org role to the current organization and returns its id, or 0 if it fails
+func (c *GrafanaClient) PostServiceAccount(name string, role string, grafanaIP string) int {
+	endpoint := "/api/serviceaccounts"
+	requestBody, _ := json.Marshal(map[string]interface{}{"name": name, "role": role, "isDisabled": false})
+	url := "http://" + c.user + ":" + c.password + "@" + c.GetGrafanaIP() + endpoint
+	req, err := http.NewRequest("POST", url, bytes.NewBuffer(requestBody))
+	if err != nil {
+		glog.Error(err)
+	}
+	status, respBody := tryRequest(req, 3)
+	// grafana answers 201 Created
+	if status != "201 Created" && !reqSuccess(status, respBody) {
+		glog.Warningln("fail to add service account " + name)
+		return 0
+	}
+	var result struct {
+		ID int `json:"id"`
+	}
+	_ = json.Unmarshal(respBody, &result)
+	return result.ID
+}
+
+// PostServiceAccountToken adds an API token to a service account in the current organization and returns the key, or "" if it fails
+func (c *GrafanaClient) PostServiceAccountToken(id int, name string, grafanaIP string) string {
+	endpoint := "/api/serviceaccounts/" + strconv.Itoa(id) + "/tokens"
+	requestBody, _ := json.Marshal(map[string]string{"name": name})
+	url := "http://" + c.user + ":" + c.password + "@" + c.GetGrafanaIP() + endpoint
+	req, err := http.NewRequest("POST", url, bytes.NewBuffer(requestBody))
+	if err != nil {
+		glog.Error(err)
+	}
+	status, respBody := tryRequest(req, 3)
+	if !reqSuccess(status, respBody) {
+		glog.Warningln("fail to add token of service account " + name)
+		return ""
+	}
+	var result struct {
+		Key string `json:"key"`
+	}
+	_ = json.Unmarshal(respBody, &result)
+	return result.Key
+}
+
+// DeleteServiceAccount deletes a service account in the current organization with all its tokens
+func (c *GrafanaClient) DeleteServiceAccount(id int, grafanaIP string) {
+	endpoint := "/api/serviceaccounts/" + strconv.Itoa(id)
+	url := "http://" + c.user + ":" + c.password + "@" + c.GetGrafanaIP() + endpoint
+	req, err := http.NewRequest("DELETE", url, nil)
+	if err != nil {
+		glog.Error(err)
+	}
+	status, respBody := tryRequest(req, 3)
+	if !reqSuccess(status, respBody) {
+		glog.Warningln("fail to delete service account " + strconv.Itoa(id))
+	}
+}
@@ -0,0 +1,347 @@
+package grafana
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/golang/glog"
+)
+
+// Team is a grafana team kept in sync with a kubernetes group. Members are logins; if Members is nil, membership is left to
+// the team sync of external authentication, and ExternalGroup is linked to the team instead.
+type Team struct {
+	Permission    string
+	Members       []string
+	ExternalGroup string
+}
+
+// SyncTeams creates the teams of a tenant organization, syncs their members, and grants each team its permission on the
+// folders of the organization that have no configured permissions. Teams in previous but not in teams are deleted.
+// Members that are not in the organization are added to it as Viewers, and it gives the logins that are in the organization
+// only for their teams. Logins in previousViewers that are no longer members of any team are removed from the organization.
+func (c *GrafanaClient) SyncTeams(tenant Tenant, teams map[string]Team, previous []string, previousViewers []string) map[string]bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	viewers := make(map[string]bool)
+	orgID := c.GetOrgID(tenant.Name, c.GetGrafanaIP())
+	var members map[string]map[string]interface{}
+	if orgID != 0 {
+		members = c.GetOrgUsers(orgID, c.GetGrafanaIP())
+	}
+	if members == nil {
+		glog.Warningln("fail to sync teams of org " + tenant.Name)
+		for _, login := range previousViewers {
+			viewers[login] = true
+		}
+		return viewers
+	}
+	c.SwitchOrg(orgID, c.GetGrafanaIP())
+	added := make(map[string]bool)
+	for _, login := range previousViewers {
+		added[login] = true
+	}
+	grants := make(map[int]int)
+	for name, team := range teams {
+		teamID := c.GetTeamID(name, c.GetGrafanaIP())
+		if teamID == 0 {
+			c.PostTeam(name, c.GetGrafanaIP())
+			teamID = c.GetTeamID(name, c.GetGrafanaIP())
+		}
+		if teamID == 0 {
+			continue
+		}
+		if team.Members != nil {
+			c.syncTeamMembers(teamID, orgID, team.Members, members, added, viewers)
+		} else if team.ExternalGroup != "" {
+			c.PostTeamGroup(teamID, team.ExternalGroup, c.GetGrafanaIP())
+		}
+		if level, ok := permissionLevels[team.Permission]; ok {
+			grants[teamID] = level
+		}
+	}
+	var removed []int
+	for _, name := range previous {
+		if _, ok := teams[name]; ok {
+			continue
+		}
+		if teamID := c.GetTeamID(name, c.GetGrafanaIP()); teamID != 0 {
+			c.DeleteTeam(teamID, c.GetGrafanaIP())
+			removed = append(removed, teamID)
+		}
+	}
+	if c.teamGrants == nil {
+		c.teamGrants = make(map[string]map[int]int)
+	}
+	c.teamGrants[tenant.Name] = grants
+	c.putTeamFolderPermissions(tenant, grants, removed)
+	for _, login := range previousViewers {
+		if viewers[login] {
+			continue
+		}
+		if member, ok := members[login]; ok {
+			userID, _ := member["userId"].(float64)
+			c.DeleteUserInOrg(int(userID), orgID, c.GetGrafanaIP())
+		}
+	}
+	glog.Flush()
+	return viewers
+}
+
+// MainOrgTeamMembers gets the logins of the members of a team in the main organization. It returns nil if the team does not exist.
+func (c *GrafanaClient) MainOrgTeamMembers(name string) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.SwitchOrg(1, c.GetGrafanaIP())
+	teamID := c.GetTeamID(name, c.GetGrafanaIP())
+	if teamID == 0 {
+		return nil
+	}
+	logins := []string{}
+	for _, member := range c.GetTeamMembers(teamID, c.GetGrafanaIP()) {
+		if login, ok := member["login"].(string); ok {
+			logins = append(logins, login)
+		}
+	}
+	return logins
+}
+
+// syncTeamMembers makes members the only members of a team. Members that are not in the organization are added to it as
+// Viewers. Members added so, now or before as listed in added, are put in viewers.
+func (c *GrafanaClient) syncTeamMembers(teamID int, orgID int, logins []string, orgMembers map[string]map[string]interface{}, added map[string]bool, viewers map[string]bool) {
+	current := make(map[string]int)
+	for _, member := range c.GetTeamMembers(teamID, c.GetGrafanaIP()) {
+		login, _ := member["login"].(string)
+		userID, _ := member["userId"].(float64)
+		current[login] = int(userID)
+	}
+	desired := make(map[string]bool)
+	for _, login := range logins {
+		desired[login] = true
+		_, inOrg := orgMembers[login]
+		if added[login] && inOrg {
+			viewers[login] = true
+		}
+		if _, ok := current[login]; ok && inOrg {
+			continue
+		}
+		userID := c.GetUserID(login, c.GetGrafanaIP())
+		if userID == 0 {
+			c.PostUserWithPassword(login, randomPassword(), c.GetGrafanaIP())
+			userID = c.GetUserID(login, c.GetGrafanaIP())
+		}
+		if userID == 0 {
+			continue
+		}
+		if !inOrg {
+			c.PostUserToOrg(login, orgID, c.GetGrafanaIP(), "Viewer")
+			orgMembers[login] = map[string]interface{}{"login": login, "userId": float64(userID), "role": "Viewer"}
+			viewers[login] = true
+		}
+		if _, ok := current[login]; !ok {
+			c.PostTeamMember(teamID, userID, c.GetGrafanaIP())
+		}
+	}
+	for login, userID := range current {
+		if !desired[login] {
+			c.DeleteTeamMember(teamID, userID, c.GetGrafanaIP())
+		}
+	}
+}
+
+// putTeamFolderPermissions grants teams their permission level on every folder of the current organization that is not
+// listed in the folder permissions of the tenant, and drops the permissions of removed teams. Other permissions are kept.
+func (c *GrafanaClient) putTeamFolderPermissions(tenant Tenant, grants map[int]int, removed []int) {
+	configured := folderPermissions(tenant)
+	for _, folder := range c.GetFolders(c.GetGrafanaIP()) {
+		title, _ := folder["title"].(string)
+		uid, _ := folder["uid"].(string)
+		if _, ok := configured[title]; ok || uid == "" {
+			continue
+		}
+		var items []map[string]interface{}
+		current := c.GetFolderPermissions(uid, c.GetGrafanaIP())
+		if current == nil || teamsGranted(current, grants, removed) {
+			continue
+		}
+		for _, p := range current {
+			item := make(map[string]interface{})
+			teamID, _ := p["teamId"].(float64)
+			userID, _ := p["userId"].(float64)
+			role, _ := p["role"].(string)
+			switch {
+			case teamID != 0:
+				if _, ok := grants[int(teamID)]; ok || containsInt(removed, int(teamID)) {
+					continue
+				}
+				item["teamId"] = int(teamID)
+			case userID != 0:
+				item["userId"] = int(userID)
+			case role != "":
+				item["role"] = role
+			default:
+				continue
+			}
+			item["permission"] = p["permission"]
+			items = append(items, item)
+		}
+		for teamID, level := range grants {
+			items = append(items, map[string]interface{}{"teamId": teamID, "permission": level})
+		}
+		c.PostFolderPermissions(uid, items, c.GetGrafanaIP())
+	}
+}
+
+// teamsGranted tells if the permissions of a folder already give every team its level and no removed team any
+func teamsGranted(permissions []map[string]interface{}, grants map[int]int, removed []int) bool {
+	levels := make(map[int]int)
+	for _, p := range permissions {
+		teamID, _ := p["teamId"].(float64)
+		level, _ := p["permission"].(float64)
+		if teamID != 0 {
+			levels[int(teamID)] = int(level)
+		}
+	}
+	for teamID, level := range grants {
+		if levels[teamID] != level {
+			return false
+		}
+	}
+	for _, teamID := range removed {
+		if _, ok := levels[teamID]; ok {
+			return false
+		}
+	}
+	return true
+}
+
+// GetFolderPermissions gets the permissions of a folder in the current organization
+func (c *GrafanaClient) GetFolderPermissions(uid string, grafanaIP string) []map[string]interface{} {
+	endpoint := "/api/folders/" + uid + "/permissions"
+	url := "http://" + c.user + ":" + c.password + "@" + c.GetGrafanaIP() + endpoint
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		glog.Error(err)
+	}
+	status, respBody := tryRequest(req, 3)
+	if !reqSuccess(status, respBody) {
+		glog.Warningln("fail to get permissions of folder " + uid)
+		return nil
+	}
+	var permissions []map[string]interface{}
+	err = json.Unmarshal(respBody, &permissions)
+	if err != nil {
+		glog.Error(err)
+		return nil
+	}
+	return permissions
+}
+
+// PostTeam adds a team to the current organization
+func (c *GrafanaClient) PostTeam(name string, grafanaIP string) {
+	endpoint := "/api/teams"
+	requestBody, _ := json.Marshal(map[string]string{"name": name})
+	url := "http://" + c.user + ":" + c.password + "@" + c.GetGrafanaIP() + endpoint
+	req, err := http.NewRequest("POST", url, bytes.NewBuffer(requestBody))
+	if err != nil {
+		glog.Error(err)
+	}
+	status, respBody := tryRequest(req, 3)
+	if !reqSuccess(status, respBody) {
+		glog.Warningln("fail to add team " + name)
+	}
+}
+
+// DeleteTeam deletes a team in the current organization
+func (c *GrafanaClient) DeleteTeam(teamID int, grafanaIP string) {
+	endpoint := "/api/teams/" + strconv.Itoa(teamID)
+	url := "http://" + c.user + ":" + c.password + "@" + c.GetGrafanaIP() + endpoint
+	req, err := http.NewRequest("DELETE", url, nil)
+	if err != nil {
+		glog.Error(err)
+	}
+	status, respBody := tryRequest(req, 3)
+	if !reqSuccess(status, respBody) {
+		glog.Warningln("fail to delete team " + strconv.Itoa(teamID))
+	}
+}
+
+// GetTeamMembers gets the members of a team in the current organization
+func (c *GrafanaClient) GetTeamMembers(teamID int, grafanaIP string) []map[string]interface{} {
+	endpoint := "/api/teams/" + strconv.Itoa(teamID) + "/members"
+	url := "http://" + c.user + ":" + c.password + "@" + c.GetGrafanaIP() + endpoint
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		glog.Error(err)
+	}
+	status, respBody := tryRequest(req, 3)
+	if !reqSuccess(status, respBody) {
+		glog.Warningln("fail to get team members")
+		return nil
+	}
+	var members []map[string]interface{}
+	err = json.Unmarshal(respBody, &members)
+	if err != nil {
+		glog.Error(err)
+		return nil
+	}
+	return members
+}
+
+// PostTeamMember adds a user to a team in the current organization
+func (c *GrafanaClient) PostTeamMember(teamID int, userID int, grafanaIP string) {
+	endpoint := "/api/teams/" + strconv.Itoa(teamID) + "/members"
+	var requestBody = []byte(`{"userId":` + strconv.Itoa(userID) + `}`)
+	url := "http://" + c.user + ":" + c.password + "@" + c.GetGrafanaIP() + endpoint
+	req, err := http.NewRequest("POST", url, bytes.NewBuffer(requestBody))
+	if err != nil {
+		glog.Error(err)
+	}
+	status, respBody := tryRequest(req, 3)
+	if !reqSuccess(status, respBody) {
+		glog.Warningln("fail to add team member")
+	}
+}
+
+// DeleteTeamMember removes a user from a team in the current organization
+func (c *GrafanaClient) DeleteTeamMember(teamID int, userID int, grafanaIP string) {
+	endpoint := "/api/teams/" + strconv.Itoa(teamID) + "/members/" + strconv.Itoa(userID)
+	url := "http://" + c.user + ":" + c.password + "@" + c.GetGrafanaIP() + endpoint
+	req, err := http.NewRequest("DELETE", url, nil)
+	if err != nil {
+		glog.Error(err)
+	}
+	status, respBody := tryRequest(req, 3)
+	if !reqSuccess(status, respBody) {
+		glog.Warningln("fail to remove team member")
+	}
+}
+
+// PostTeamGroup links an external group to a team, for the team sync of external authentication
+func (c *GrafanaClient) PostTeamGroup(teamID int, group string, grafanaIP string) {
+	endpoint := "/api/teams/" + strconv.Itoa(teamID) + "/groups"
+	requestBody, _ := json.Marshal(map[string]string{"groupId": group})
+	url := "http://" + c.user + ":" + c.password + "@" + c.GetGrafanaIP() + endpoint
+	req, err := http.NewRequest("POST", url, bytes.NewBuffer(requestBody))
+	if err != nil {
+		glog.Error(err)
+	}
+	status, respBody := tryRequest(req, 3)
+	// the group is already linked
+	if status == "400 Bad Request" || status == "409 Conflict" {
+		return
+	}
+	if !reqSuccess(status, respBody) {
+		glog.Warningln("fail to link group " + group + " to team")
+	}
+}
+
+func containsInt(list []int, value int) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
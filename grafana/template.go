@@ -0,0 +1,158 @@
+package grafana
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"text/template"
+)
+
+// templateTag marks dashboards that are rendered as go templates for each tenant
+const templateTag = "tenant-template"
+
+// tenantIDAnnotation of a namespace sets the tenant id of multi-tenant backends, which defaults to the namespace name
+const tenantIDAnnotation = "grafana-controller/tenant-id"
+
+// Tenant is a kubernetes tenant that owns a grafana organization. Name is the name of the organization, and Namespaces
+// are the namespaces of the tenant. A tenant without Namespaces is the namespace Name.
+type Tenant struct {
+	Name        string
+	Namespaces  []string
+	Labels      map[string]string
+	Annotations map[string]string
+}
+
+// NamespaceList gives the namespaces of a tenant
+func (t Tenant) NamespaceList() []string {
+	if len(t.Namespaces) == 0 {
+		return []string{t.Name}
+	}
+	return t.Namespaces
+}
+
+// namespaceRegex gives the regex of the Namespace variable of tenant dashboards, e.g. "team-a-dev|team-a-prod"
+func (t Tenant) namespaceRegex() string {
+	return strings.Join(t.NamespaceList(), "|")
+}
+
+// TemplateContext is the data tenant dashboards are rendered with, e.g. {% .Namespace %} or {% index .Labels "team" %}
+type TemplateContext struct {
+	Namespace string
+	// Namespaces are all the namespaces of a tenant grouped by label, or Namespace
+	Namespaces  []string
+	Labels      map[string]string
+	Annotations map[string]string
+	ClusterName string
+	OrgName     string
+	DataSources []string
+	// TenantID identifies the tenant at multi-tenant backends such as Mimir and Loki
+	TenantID string
+}
+
+// isTemplate tells if a dashboard has the tenant-template tag
+func isTemplate(dashboard map[string]interface{}) bool {
+	tags, _ := dashboard["tags"].([]interface{})
+	for _, tag := range tags {
+		if tag == templateTag {
+			return true
+		}
+	}
+	return false
+}
+
+// renderDashboard renders a dashboard tagged tenant-template as a go text/template with the tenant context and returns a new dashboard.
+// Actions are delimited by {% and %}, since {{ }} is used by grafana legends. Other dashboards are returned as they are.
+func renderDashboard(dashboard map[string]interface{}, context TemplateContext) (map[string]interface{}, error) {
+	if !isTemplate(dashboard) {
+		return dashboard, nil
+	}
+	return renderJSON(dashboard, context)
+}
+
+// renderJSON renders any json object, such as a dashboard or a library panel model, by rendering each of its
+// strings as a go template, so quotes in actions need no escaping and rendered values stay valid json
+func renderJSON(object map[string]interface{}, context TemplateContext) (map[string]interface{}, error) {
+	rendered, err := renderValue(object, context)
+	if err != nil {
+		return nil, err
+	}
+	return rendered.(map[string]interface{}), nil
+}
+
+// renderValue renders the strings of a decoded json value and returns a new value
+func renderValue(value interface{}, context TemplateContext) (interface{}, error) {
+	switch v := value.(type) {
+	case string:
+		return renderString(v, context)
+	case map[string]interface{}:
+		result := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			rendered, err := renderValue(item, context)
+			if err != nil {
+				return nil, err
+			}
+			result[key] = rendered
+		}
+		return result, nil
+	case []interface{}:
+		result := make([]interface{}, len(v))
+		for i, item := range v {
+			rendered, err := renderValue(item, context)
+			if err != nil {
+				return nil, err
+			}
+			result[i] = rendered
+		}
+		return result, nil
+	default:
+		return value, nil
+	}
+}
+
+// renderString renders a single string as a go template
+func renderString(s string, context TemplateContext) (string, error) {
+	if !strings.Contains(s, "{%") {
+		return s, nil
+	}
+	tmpl, err := template.New("string").Delims("{%", "%}").Funcs(template.FuncMap{
+		"join": strings.Join,
+	}).Option("missingkey=zero").Parse(s)
+	if err != nil {
+		return "", err
+	}
+	var rendered bytes.Buffer
+	err = tmpl.Execute(&rendered, context)
+	if err != nil {
+		return "", err
+	}
+	return rendered.String(), nil
+}
+
+// templateContext creates the context to render the dashboards of a tenant with
+func templateContext(tenant Tenant, datasources []map[string]interface{}) TemplateContext {
+	var names []string
+	for _, ds := range datasources {
+		if name, ok := ds["name"].(string); ok {
+			names = append(names, name)
+		}
+	}
+	tenantID := tenant.Annotations[tenantIDAnnotation]
+	if tenantID == "" {
+		tenantID = tenant.Name
+	}
+	return TemplateContext{
+		Namespace:   tenant.Name,
+		Namespaces:  tenant.NamespaceList(),
+		Labels:      tenant.Labels,
+		Annotations: tenant.Annotations,
+		ClusterName: clusterName(),
+		OrgName:     tenant.Name,
+		DataSources: names,
+		TenantID:    tenantID,
+	}
+}
+
+func clusterName() string {
+	name := os.Getenv("CLUSTER_NAME")
+	return name
+}
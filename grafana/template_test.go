@@ -0,0 +1,87 @@
+package grafana
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestRenderString(t *testing.T) {
+	context := TemplateContext{
+		Namespace: "team-a",
+		Labels:    map[string]string{"team": "a", "quote": "say \"hi\"\nbye"},
+	}
+	tests := []struct {
+		name     string
+		template string
+		want     string
+	}{
+		{"plain", "no actions", "no actions"},
+		{"field", "ns {% .Namespace %}", "ns team-a"},
+		{"quoted argument", `team {% index .Labels "team" %}`, "team a"},
+		{"backquoted argument", "team {% index .Labels `team` %}", "team a"},
+		{"quote and newline", `{% index .Labels "quote" %}`, "say \"hi\"\nbye"},
+		{"missing key", `[{% index .Labels "missing" %}]`, "[]"},
+	}
+	for _, test := range tests {
+		got, err := renderString(test.template, context)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestRenderJSON(t *testing.T) {
+	context := TemplateContext{
+		Namespace:  "team-a",
+		Namespaces: []string{"team-a-dev", "team-a-prod"},
+		Labels:     map[string]string{"team": "a", "quote": "x\", \"injected\": \"y\n"},
+	}
+	tests := []struct {
+		name   string
+		object string
+		want   string
+	}{
+		{
+			"quoted argument",
+			`{"title": "{% index .Labels \"team\" %}"}`,
+			`{"title": "a"}`,
+		},
+		{
+			"quote and newline",
+			`{"title": "{% index .Labels \"quote\" %}"}`,
+			`{"title": "x\", \"injected\": \"y\n"}`,
+		},
+		{
+			"missing key",
+			`{"title": "[{% index .Labels \"missing\" %}]"}`,
+			`{"title": "[]"}`,
+		},
+		{
+			"nested",
+			`{"panels": [{"targets": [{"expr": "up{namespace=~\"{% join .Namespaces \"|\" %}\"}"}], "id": 1}], "editable": true}`,
+			`{"panels": [{"targets": [{"expr": "up{namespace=~\"team-a-dev|team-a-prod\"}"}], "id": 1}], "editable": true}`,
+		},
+	}
+	for _, test := range tests {
+		var object, want map[string]interface{}
+		if err := json.Unmarshal([]byte(test.object), &object); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if err := json.Unmarshal([]byte(test.want), &want); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		got, err := renderJSON(object, context)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %v, want %v", test.name, got, want)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package grafana
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// the range of dashboard schema versions accepted by default, from grafana 5.0 on. MAX_SCHEMA_VERSION raises the
+// maximum for dashboards exported from newer grafana versions.
+const (
+	minSchemaVersion        = 14
+	defaultMaxSchemaVersion = 39
+)
+
+// variableRef matches $var, ${var}, ${var:format} and [[var]] references
+var variableRef = regexp.MustCompile(`\$\{(\w+)(?::[^}]*)?\}|\[\[(\w+)(?::[^\]]*)?\]\]|\$(\w+)`)
+
+// dataSources holds the names and uids of the data sources of an organization
+type dataSources map[string]bool
+
+// validateDashboard checks dashboard json before it is posted and returns every problem found. If datasources is nil, data source references are not checked.
+func validateDashboard(dashboard map[string]interface{}, datasources dataSources) []string {
+	var problems []string
+	if title, _ := dashboard["title"].(string); strings.TrimSpace(title) == "" {
+		problems = append(problems, "title is missing")
+	}
+	if version, ok := dashboard["schemaVersion"].(float64); !ok {
+		problems = append(problems, "schemaVersion is missing")
+	} else if maxVersion := maxSchemaVersion(); version < minSchemaVersion || version > float64(maxVersion) {
+		problems = append(problems, fmt.Sprintf("schemaVersion %v is not in range %d-%d", version, minSchemaVersion, maxVersion))
+	}
+
+	variables := make(map[string]bool)
+	templating, _ := dashboard["templating"].(map[string]interface{})
+	list, _ := templating["list"].([]interface{})
+	for _, t := range list {
+		variable, _ := t.(map[string]interface{})
+		name, _ := variable["name"].(string)
+		if name == "" {
+			problems = append(problems, "template variable without name")
+			continue
+		}
+		variables[name] = true
+	}
+	for _, t := range list {
+		variable, _ := t.(map[string]interface{})
+		if variable == nil {
+			continue
+		}
+		where := fmt.Sprintf("template variable %v", variable["name"])
+		problems = append(problems, checkDataSource(variable["datasource"], datasources, variables, where)...)
+		problems = append(problems, checkVariables(variable["query"], variables, where)...)
+	}
+
+	ids := make(map[float64]bool)
+	for _, panel := range dashboardPanels(dashboard) {
+		title, _ := panel["title"].(string)
+		id, ok := panel["id"].(float64)
+		where := "panel " + strconv.Quote(title)
+		if !ok {
+			problems = append(problems, where+" has no id")
+		} else {
+			where = fmt.Sprintf("panel %v %q", id, title)
+			if ids[id] {
+				problems = append(problems, fmt.Sprintf("duplicate panel id %v", id))
+			}
+			ids[id] = true
+		}
+		problems = append(problems, checkDataSource(panel["datasource"], datasources, variables, where)...)
+		problems = append(problems, checkVariables(panel["title"], variables, where)...)
+		targets, _ := panel["targets"].([]interface{})
+		for j, t := range targets {
+			target, _ := t.(map[string]interface{})
+			targetWhere := fmt.Sprintf("%s target %d", where, j)
+			problems = append(problems, checkDataSource(target["datasource"], datasources, variables, targetWhere)...)
+			for _, field := range []string{"expr", "query", "rawSql", "target"} {
+				problems = append(problems, checkVariables(target[field], variables, targetWhere)...)
+			}
+		}
+	}
+	return problems
+}
+
+// dashboardPanels lists the panels of a dashboard, including panels in rows
+func dashboardPanels(dashboard map[string]interface{}) []map[string]interface{} {
+	var panels []map[string]interface{}
+	var walk func(list interface{})
+	walk = func(list interface{}) {
+		items, _ := list.([]interface{})
+		for _, p := range items {
+			panel, ok := p.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			if panel["type"] != "row" {
+				panels = append(panels, panel)
+			}
+			walk(panel["panels"])
+		}
+	}
+	walk(dashboard["panels"])
+	rows, _ := dashboard["rows"].([]interface{})
+	for _, r := range rows {
+		row, _ := r.(map[string]interface{})
+		walk(row["panels"])
+	}
+	return panels
+}
+
+// checkDataSource checks that a data source reference, a name or a {"uid": ...} object, exists in the organization.
+// References to template variables are checked like other variables.
+func checkDataSource(ref interface{}, datasources dataSources, variables map[string]bool, where string) []string {
+	if datasources == nil {
+		return nil
+	}
+	var name string
+	switch r := ref.(type) {
+	case string:
+		name = r
+	case map[string]interface{}:
+		name, _ = r["uid"].(string)
+	}
+	if variableRef.MatchString(name) {
+		return checkVariables(name, variables, where)
+	}
+	if name == "" || strings.HasPrefix(name, "-- ") || name == "grafana" || datasources[name] {
+		return nil
+	}
+	return []string{where + " uses data source " + strconv.Quote(name) + " which does not exist in the org"}
+}
+
+// checkVariables reports the template variables referenced in s that are neither defined in the dashboard nor built into grafana
+func checkVariables(s interface{}, variables map[string]bool, where string) []string {
+	str, ok := s.(string)
+	if !ok {
+		return nil
+	}
+	var problems []string
+	for _, match := range variableRef.FindAllStringSubmatch(str, -1) {
+		name := match[1] + match[2] + match[3]
+		if variables[name] || isBuiltinVariable(name) {
+			continue
+		}
+		problems = append(problems, where+" uses unresolved variable $"+name)
+	}
+	return problems
+}
+
+func isBuiltinVariable(name string) bool {
+	if strings.HasPrefix(name, "__") {
+		return true
+	}
+	if _, err := strconv.Atoi(name); err == nil {
+		// regex capture groups such as $1 in label_replace
+		return true
+	}
+	switch name {
+	case "interval", "interval_ms", "timeFilter", "timeFrom", "timeTo":
+		return true
+	}
+	return false
+}
+
+// maxSchemaVersion reads MAX_SCHEMA_VERSION, the newest dashboard schema version accepted. The default is 39.
+func maxSchemaVersion() int {
+	version, err := strconv.Atoi(os.Getenv("MAX_SCHEMA_VERSION"))
+	if err != nil || version < minSchemaVersion {
+		return defaultMaxSchemaVersion
+	}
+	return version
+}
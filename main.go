@@ -1,17 +1,27 @@
 package main
 
 import (
+	"flag"
 	"k8s-grafana-controller/controller"
 
 	"github.com/golang/glog"
 )
 
+var (
+	restore    = flag.String("restore", "", "(optional) restore a dashboard backup into -restore-org and exit. A backup directory, or a ConfigMap or Secret in BACKUP_NAMESPACE")
+	restoreOrg = flag.String("restore-org", "", "(optional) organization to restore the backup into, created if it does not exist")
+)
+
 func main() {
 	clientset, err := controller.InitClientSet()
 	if err != nil {
 		glog.Fatal(err)
 	}
-	grafanaClient, err := controller.InitGrafanaClient()
+	grafanaClient, err := controller.InitGrafanaClient(clientset)
+	if err != nil {
+		glog.Fatal(err)
+	}
+	dynamicClient, err := controller.InitDynamicClient()
 	if err != nil {
 		glog.Fatal(err)
 	}
@@ -19,8 +29,31 @@ func main() {
 	if err != nil {
 		glog.Fatal(err)
 	}
+	if *restore != "" {
+		err = controller.RestoreBackup(clientset, controllerClient, *restore, *restoreOrg)
+		if err != nil {
+			glog.Fatal(err)
+		}
+		glog.Flush()
+		return
+	}
 	glog.Flush()
+	controller.WatchHierarchy(clientset, dynamicClient, controllerClient)
+	controller.WatchCapsuleTenants(clientset, dynamicClient, controllerClient)
 	go controller.WatchTenants(clientset, controllerClient)
-	go controller.WatchGrafana(clientset, grafanaClient)
+	go controller.WatchGrafana(clientset, grafanaClient, controllerClient)
+	go controller.ResyncTenants(clientset, controllerClient)
+	go controller.WatchDashboardConfigMaps(clientset, controllerClient)
+	go controller.WatchRoleBindings(clientset, controllerClient)
+	go controller.WatchTeamMembers(clientset, controllerClient)
+	go controller.WatchOrgAdmins(clientset, controllerClient)
+	controller.WatchAnnotations(clientset, controllerClient)
+	controller.WatchServices(clientset, grafanaClient, controllerClient)
+	controller.WatchDataSourceSecrets(clientset, controllerClient)
+	go controller.CheckDataSources(clientset, controllerClient)
+	go controller.SyncAuthMapping(clientset, controllerClient)
+	go controller.WatchAPITokenSecrets(clientset, controllerClient)
+	go controller.RotateViewerPasswords(clientset, controllerClient)
+	go controller.ServeMetrics()
 	select {}
 }